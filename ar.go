@@ -0,0 +1,143 @@
+package ztgrep
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	arMagic       = "!<arch>\n"
+	arHeaderSize  = 60
+	arMaxNameSize = 4096
+)
+
+var errArHeader = errors.New("invalid ar header")
+
+// arReader calls fn for each file in an ar archive, including Debian packages.
+// Both GNU and BSD long file names are supported. Symbol tables are skipped.
+func arReader(r io.Reader, fn func(string, fs.FileInfo, io.Reader) error) error {
+	magic := make([]byte, len(arMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return err
+	}
+	if string(magic) != arMagic {
+		return errors.New("invalid ar archive")
+	}
+	var names []byte // GNU long name table
+	b := make([]byte, arHeaderSize)
+	for {
+		if _, err := io.ReadFull(r, b); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		h, err := parseArHeader(b)
+		if err != nil {
+			return err
+		}
+		size := h.size
+		fr := io.LimitReader(r, size)
+		name := strings.TrimRight(string(b[0:16]), " ")
+		switch {
+		case name == "//":
+			if names, err = io.ReadAll(fr); err != nil {
+				return err
+			}
+			name = ""
+		case name == "/", name == "/SYM64/":
+			name = ""
+		case strings.HasPrefix(name, "#1/"):
+			n, err := strconv.ParseInt(name[3:], 10, 64)
+			if err != nil || n < 0 || n > h.size || n > arMaxNameSize {
+				return errArHeader
+			}
+			nb := make([]byte, n)
+			if _, err := io.ReadFull(fr, nb); err != nil {
+				return err
+			}
+			h.size -= n
+			name = string(bytes.TrimRight(nb, "\x00"))
+			if name == "__.SYMDEF" || name == "__.SYMDEF SORTED" {
+				name = ""
+			}
+		case strings.HasPrefix(name, "/"):
+			off, err := strconv.Atoi(name[1:])
+			if err != nil || off >= len(names) {
+				return errArHeader
+			}
+			name = string(names[off:])
+			if i := strings.Index(name, "/\n"); i >= 0 {
+				name = name[:i]
+			} else if i := strings.IndexByte(name, '\n'); i >= 0 {
+				name = name[:i]
+			}
+		default:
+			name = strings.TrimSuffix(name, "/")
+		}
+		if name != "" {
+			h.name = name
+			if err := fn(name, h, fr); err != nil {
+				return err
+			}
+		}
+		if _, err := io.Copy(io.Discard, fr); err != nil {
+			return err
+		}
+		if size%2 != 0 {
+			if _, err := io.CopyN(io.Discard, r, 1); err != nil && err != io.EOF {
+				return err
+			}
+		}
+	}
+}
+
+func parseArHeader(b []byte) (*arFileInfo, error) {
+	if string(b[58:60]) != "`\n" {
+		return nil, errArHeader
+	}
+	field := func(lo, hi int) string {
+		return strings.TrimSpace(string(b[lo:hi]))
+	}
+	h := &arFileInfo{}
+	var err error
+	if h.size, err = strconv.ParseInt(field(48, 58), 10, 64); err != nil || h.size < 0 {
+		return nil, errArHeader
+	}
+	// some archives leave the remaining fields blank
+	if s := field(16, 28); s != "" {
+		mtime, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: mtime", errArHeader)
+		}
+		h.mtime = time.Unix(mtime, 0)
+	}
+	if s := field(40, 48); s != "" {
+		mode, err := strconv.ParseUint(s, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%w: mode", errArHeader)
+		}
+		h.mode = fs.FileMode(mode).Perm()
+	}
+	return h, nil
+}
+
+type arFileInfo struct {
+	name  string
+	size  int64
+	mode  fs.FileMode
+	mtime time.Time
+}
+
+func (fi *arFileInfo) Name() string       { return path.Base(fi.name) }
+func (fi *arFileInfo) Size() int64        { return fi.size }
+func (fi *arFileInfo) Mode() fs.FileMode  { return fi.mode }
+func (fi *arFileInfo) ModTime() time.Time { return fi.mtime }
+func (fi *arFileInfo) IsDir() bool        { return false }
+func (fi *arFileInfo) Sys() interface{}   { return nil }
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/jessevdk/go-flags"
 
@@ -15,9 +18,42 @@ type Options struct {
 	Search struct {
 		SkipBody bool `short:"b" long:"skip-body" description:"Skip file bodies"`
 		SkipName bool `short:"n" long:"skip-name" description:"Skip file names inside of tarballs"`
+		Name string `long:"name" value-name:"REGEXP" description:"Match file names against REGEXP, in place of the regexp argument"`
+		Body string `long:"body" value-name:"REGEXP" description:"Match file bodies against REGEXP, in place of the regexp argument"`
+		And bool `long:"and" description:"Only match bodies of files with names matching --name, and only report body matches"`
 		MaxZipSize int64 `short:"z" long:"max-zip-size" default:"0" default-mask:"10 MB" description:"Maximum zip file size to search in bytes"`
+		LineNumber bool `short:"N" long:"line-number" description:"Print matching lines in file bodies with line numbers"`
+		After int `short:"A" long:"after-context" value-name:"NUM" description:"Print NUM lines of context after matching lines (implies -N)"`
+		Before int `short:"B" long:"before-context" value-name:"NUM" description:"Print NUM lines of context before matching lines (implies -N)"`
+		Context int `short:"C" long:"context" value-name:"NUM" description:"Print NUM lines of context around matching lines (implies -N)"`
+		Recursive bool `short:"r" long:"recursive" description:"Search files within directories"`
+		FollowLinks bool `short:"R" long:"dereference-recursive" description:"Search files within directories, following symbolic links"`
+		Include []string `long:"include" value-name:"GLOB" description:"Only search files within directories matching GLOB"`
+		Exclude []string `long:"exclude" value-name:"GLOB" description:"Skip files and directories within directories matching GLOB"`
+		EntryInclude []string `long:"entry-include" value-name:"GLOB" description:"Only search archive entries matching GLOB (prefix with ! to skip)"`
+		EntryExclude []string `long:"entry-exclude" value-name:"GLOB" description:"Skip archive entries matching GLOB"`
+		AllNames bool `long:"all-names" description:"Also match names of paths and of compressed files without their compression extensions"`
+		PathMatch bool `short:"p" long:"path-match" description:"Match file names against the full nested path, including the top-level path"`
+		PathSeparator string `long:"path-separator" value-name:"SEP" default:":" description:"Separator between nested paths for --path-match"`
+		Images bool `long:"images" description:"Search tar files and OCI layout directories as container images, by image and layer"`
+		MergeLayers bool `long:"merge-layers" description:"Only search files visible in the final filesystem of each container image (implies --images)"`
+		BufferZip bool `long:"buffer-zip" description:"Read nested zip files into memory instead of streaming them"`
+		Spill bool `short:"S" long:"spill" description:"Search zip, 7z, and iso files larger than the maximum zip file size using temporary files"`
+		TempDir string `long:"temp-dir" value-name:"DIR" description:"Directory for temporary files (default: system temporary directory)"`
+		MaxTempSize int64 `long:"max-temp-size" value-name:"BYTES" description:"Maximum total size of temporary files in bytes (default: unlimited)"`
+		MaxCount int `short:"m" long:"max-count" value-name:"NUM" description:"Stop searching each file after NUM matches"`
+		Exec bool `short:"x" long:"exec" description:"Decompress xz and zstd using the xz and zstd CLIs on $PATH"`
+		Detect string `short:"d" long:"detect" default:"both" choice:"both" choice:"ext" choice:"magic" description:"Identify formats by file headers (magic), file extensions (ext), or both"`
 	} `group:"Search Options"`
 
+	Output struct {
+		JSON bool `short:"j" long:"json" description:"Print results as JSON objects, one per line"`
+		Quiet bool `short:"q" long:"quiet" description:"Print nothing and stop searching after the first match"`
+		NoMessages bool `short:"s" long:"no-messages" description:"Suppress error messages about unreadable files"`
+		FilesWithMatches bool `short:"l" long:"files-with-matches" description:"Print only the path of each file with a match"`
+		Ordered bool `long:"ordered" description:"Print results in the order of paths, even when searched in parallel"`
+	} `group:"Output Options"`
+
 	General struct {
 		Version bool `short:"v" long:"version" description:"Return ztgrep version"`
 	} `group:"General Options"`
@@ -28,51 +64,210 @@ var (
 	opts Options
 )
 
+// exit statuses follow grep conventions
+const (
+	exitMatch   = 0
+	exitNoMatch = 1
+	exitError   = 2
+)
+
 func main() {
 	log.SetFlags(0)
 
 	parser := flags.NewParser(&opts, flags.HelpFlag|flags.PassAfterNonOption|flags.PassDoubleDash)
-	parser.Usage = "[OPTIONS] regexp paths..."
+	parser.Usage = "[OPTIONS] regexp paths...\n  ztgrep [OPTIONS] --name=REGEXP --body=REGEXP paths..."
 	restArgs, err := parser.Parse()
 	if err != nil {
 		if err, ok := err.(*flags.Error); ok && err.Type == flags.ErrHelp {
 			log.Fatal(err)
 		}
-		log.Fatalf("Invalid arguments: %s", err)
+		log.Printf("Invalid arguments: %s", err)
+		os.Exit(exitError)
 	}
 	if opts.General.Version {
 		fmt.Printf("ztgrep v%s\n", Version)
 		os.Exit(0)
 	}
-	if len(restArgs) == 0 {
+	if opts.Search.And && opts.Search.Name == "" {
+		log.Print("Invalid arguments: --and requires --name")
+		os.Exit(exitError)
+	}
+	split := opts.Search.Name != "" || opts.Search.Body != ""
+	if len(restArgs) == 0 && !split {
 		parser.WriteHelp(os.Stderr)
 		os.Exit(0)
 	}
-	if len(restArgs) == 1 {
+	var expr string
+	if !split {
+		expr, restArgs = restArgs[0], restArgs[1:]
+	}
+	if len(restArgs) == 0 {
 		restArgs = append(restArgs, "-")
 	}
-	if err := grep(restArgs[0], restArgs[1:]); err != nil {
-		log.Fatalf("Failed: %s", err)
+	status, err := grep(expr, restArgs)
+	if err != nil {
+		log.Printf("Failed: %s", err)
+		os.Exit(exitError)
 	}
+	os.Exit(status)
 }
 
-func grep(expr string, paths []string) error {
-	zt, err := ztgrep.New(expr)
+func grep(expr string, paths []string) (status int, err error) {
+	var zt *ztgrep.ZTgrep
+	if opts.Search.Name != "" || opts.Search.Body != "" {
+		zt, err = ztgrep.NewSplit(opts.Search.Name, opts.Search.Body)
+	} else {
+		zt, err = ztgrep.New(expr)
+	}
 	if err != nil {
-		return err
+		return exitError, err
 	}
 	if opts.Search.MaxZipSize != 0 {
 		zt.MaxZipSize = opts.Search.MaxZipSize
 	}
 	zt.SkipName = opts.Search.SkipName
+	zt.RequireName = opts.Search.And
+	zt.AllNames = opts.Search.AllNames
+	zt.PathMatch = opts.Search.PathMatch
+	zt.PathSeparator = opts.Search.PathSeparator
+	zt.StreamZip = !opts.Search.BufferZip
+	zt.Spill = opts.Search.Spill
+	zt.TempDir = opts.Search.TempDir
+	zt.MaxTempSize = opts.Search.MaxTempSize
 	zt.SkipBody = opts.Search.SkipBody
-	for res := range zt.Start(paths) {
+	switch opts.Search.Detect {
+	case "ext":
+		zt.Detect = ztgrep.DetectExt
+	case "magic":
+		zt.Detect = ztgrep.DetectMagic
+	}
+	zt.Exec = opts.Search.Exec
+	zt.Recursive = opts.Search.Recursive || opts.Search.FollowLinks
+	zt.FollowLinks = opts.Search.FollowLinks
+	zt.Include = opts.Search.Include
+	zt.Exclude = opts.Search.Exclude
+	zt.EntryInclude = opts.Search.EntryInclude
+	zt.EntryExclude = opts.Search.EntryExclude
+	zt.Images = opts.Search.Images || opts.Search.MergeLayers
+	zt.MergeLayers = opts.Search.MergeLayers
+	zt.Lines = opts.Search.LineNumber
+	zt.Ordered = opts.Output.Ordered
+	zt.MaxCount = opts.Search.MaxCount
+	if opts.Output.FilesWithMatches {
+		zt.MaxCount = 1
+	}
+	zt.Before, zt.After = opts.Search.Context, opts.Search.Context
+	if opts.Search.Before != 0 {
+		zt.Before = opts.Search.Before
+	}
+	if opts.Search.After != 0 {
+		zt.After = opts.Search.After
+	}
+	if opts.Output.FilesWithMatches || opts.Output.Quiet {
+		// like grep, only whole files are reported
+		zt.Lines, zt.Before, zt.After = false, 0, 0
+	}
+	showContext := zt.Before > 0 || zt.After > 0
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		last                     ztgrep.Result
+		matched, failed, printed bool
+	)
+	enc := json.NewEncoder(os.Stdout)
+	for res := range zt.StartContext(ctx, paths) {
+		if res.Err != nil {
+			failed = true
+		} else {
+			matched = true
+		}
+		if res.Err == nil && opts.Output.Quiet {
+			cancel()
+			return exitMatch, nil
+		}
+		if res.Err == nil && opts.Output.FilesWithMatches {
+			res = ztgrep.Result{Path: res.Path[:1], Info: res.Info, Body: res.Body}
+		}
+		if opts.Output.JSON {
+			if err := enc.Encode(newJSONResult(res)); err != nil {
+				return exitError, err
+			}
+			continue
+		}
 		path := strings.Join(res.Path, ":")
 		if res.Err != nil {
-			log.Printf("ztgrep: %s: %s", path, res.Err)
+			if !opts.Output.NoMessages {
+				log.Printf("ztgrep: %s: %s", path, res.Err)
+			}
+			continue
+		}
+		// separate groups of lines after any output, like grep
+		if showContext && res.LineNum > 0 {
+			if printed && (res.LineNum != last.LineNum+1 || path != strings.Join(last.Path, ":")) {
+				fmt.Println("--")
+			}
+			last = res
+		}
+		printed = true
+		if res.Context {
+			fmt.Printf("%s-%d-%s\n", path, res.LineNum, res.Line)
+		} else if res.LineNum > 0 {
+			fmt.Printf("%s:%d:%s\n", path, res.LineNum, res.Line)
 		} else {
 			fmt.Println(path)
 		}
 	}
-	return nil
+	switch {
+	case failed:
+		return exitError, nil
+	case matched:
+		return exitMatch, nil
+	default:
+		return exitNoMatch, nil
+	}
+}
+
+type jsonResult struct {
+	Path    []string   `json:"path"`
+	Kind    string     `json:"kind,omitempty"`
+	Line    *string    `json:"line,omitempty"`
+	LineNum int        `json:"line_number,omitempty"`
+	Offset  *int64     `json:"offset,omitempty"`
+	Error   string     `json:"error,omitempty"`
+	Entry   *jsonEntry `json:"entry,omitempty"`
+}
+
+type jsonEntry struct {
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode"`
+	ModTime time.Time `json:"mtime"`
+}
+
+func newJSONResult(res ztgrep.Result) jsonResult {
+	out := jsonResult{Path: res.Path}
+	switch {
+	case res.Err != nil:
+		out.Error = res.Err.Error()
+	case res.Context:
+		out.Kind = "context"
+	case res.Body:
+		out.Kind = "body"
+	default:
+		out.Kind = "name"
+	}
+	if res.LineNum > 0 {
+		out.Line = &res.Line
+		out.LineNum = res.LineNum
+		out.Offset = &res.Offset
+	}
+	if res.Info != nil {
+		out.Entry = &jsonEntry{
+			Size:    res.Info.Size(),
+			Mode:    res.Info.Mode().String(),
+			ModTime: res.Info.ModTime(),
+		}
+	}
+	return out
 }
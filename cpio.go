@@ -0,0 +1,236 @@
+package ztgrep
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	cpioNewcMagic   = "070701"
+	cpioCRCMagic    = "070702"
+	cpioODCMagic    = "070707"
+	cpioBinMagic    = 070707
+	cpioNewcSize    = 110
+	cpioODCSize     = 76
+	cpioBinSize     = 26
+	cpioTrailerName = "TRAILER!!!"
+	cpioMaxNameSize = 4096
+)
+
+var errCPIOHeader = errors.New("invalid cpio header")
+
+// cpioReader calls fn for each file in a cpio archive in the SVR4 (newc or crc), POSIX (odc), or old binary format.
+// Concatenated archives, such as those in initramfs images, are read until EOF.
+// Archives may be followed by compressed archives, such as the root filesystem after early microcode in initramfs images.
+func (zt *ZTgrep) cpioReader(r io.Reader, fn func(string, fs.FileInfo, io.Reader) error) error {
+	br := bufio.NewReader(r)
+	for first := true; ; {
+		magic, err := br.Peek(6)
+		if err != nil && (first || len(magic) < 2) {
+			if !first && err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		var (
+			h     *cpioFileInfo
+			align int64
+		)
+		switch {
+		case hasPrefixAt(magic, 0, cpioNewcMagic), hasPrefixAt(magic, 0, cpioCRCMagic):
+			h, err = readCPIONewc(br)
+			align = 4
+		case hasPrefixAt(magic, 0, cpioODCMagic):
+			h, err = readCPIOODC(br)
+			align = 1
+		case binary.LittleEndian.Uint16(magic) == cpioBinMagic:
+			h, err = readCPIOBin(br, binary.LittleEndian)
+			align = 2
+		case binary.BigEndian.Uint16(magic) == cpioBinMagic:
+			h, err = readCPIOBin(br, binary.BigEndian)
+			align = 2
+		case first:
+			return errCPIOHeader
+		default:
+			hdr, _ := br.Peek(headerSize)
+			zf, _ := zt.magicDecompressor(hdr)
+			if zf == nil {
+				return errCPIOHeader
+			}
+			rc, err := zf(context.Background(), br)
+			if err != nil {
+				return err
+			}
+			defer rc.Close()
+			br, first = bufio.NewReader(rc), true
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		first = false
+		if h.name == cpioTrailerName {
+			if err := skipCPIOPadding(br); err != nil {
+				return err
+			}
+			continue
+		}
+		fr := io.LimitReader(br, h.size)
+		if err := fn(h.name, h, fr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(io.Discard, fr); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(io.Discard, br, padTo(h.size, align)); err != nil {
+			return err
+		}
+	}
+}
+
+func readCPIONewc(r io.Reader) (*cpioFileInfo, error) {
+	b := make([]byte, cpioNewcSize)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	var fields [13]int64
+	for i := range fields {
+		v, err := strconv.ParseUint(string(b[6+8*i:14+8*i]), 16, 32)
+		if err != nil {
+			return nil, errCPIOHeader
+		}
+		fields[i] = int64(v)
+	}
+	return readCPIOName(r, &cpioFileInfo{
+		size:  fields[6],
+		mode:  unixMode(fields[1]),
+		mtime: time.Unix(fields[5], 0),
+	}, fields[11], padTo(cpioNewcSize+fields[11], 4))
+}
+
+func readCPIOODC(r io.Reader) (*cpioFileInfo, error) {
+	b := make([]byte, cpioODCSize)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	field := func(lo, hi int) (int64, error) {
+		return strconv.ParseInt(string(b[lo:hi]), 8, 64)
+	}
+	mode, err1 := field(18, 24)
+	mtime, err2 := field(48, 59)
+	nameSize, err3 := field(59, 65)
+	size, err4 := field(65, 76)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		return nil, errCPIOHeader
+	}
+	return readCPIOName(r, &cpioFileInfo{
+		size:  size,
+		mode:  unixMode(mode),
+		mtime: time.Unix(mtime, 0),
+	}, nameSize, 0)
+}
+
+func readCPIOBin(r io.Reader, order binary.ByteOrder) (*cpioFileInfo, error) {
+	var h struct {
+		Magic, Dev, Ino, Mode, UID, GID, Nlink, Rdev uint16
+		Mtime                                        [2]uint16
+		NameSize                                     uint16
+		FileSize                                     [2]uint16
+	}
+	if err := binary.Read(r, order, &h); err != nil {
+		return nil, err
+	}
+	nameSize := int64(h.NameSize)
+	return readCPIOName(r, &cpioFileInfo{
+		size:  int64(h.FileSize[0])<<16 | int64(h.FileSize[1]),
+		mode:  unixMode(int64(h.Mode)),
+		mtime: time.Unix(int64(h.Mtime[0])<<16|int64(h.Mtime[1]), 0),
+	}, nameSize, padTo(cpioBinSize+nameSize, 2))
+}
+
+// readCPIOName reads a NUL-terminated name of the given size followed by padding.
+func readCPIOName(r io.Reader, h *cpioFileInfo, size, pad int64) (*cpioFileInfo, error) {
+	if size < 0 || size > cpioMaxNameSize || h.size < 0 {
+		return nil, errCPIOHeader
+	}
+	name := make([]byte, size+pad)
+	if _, err := io.ReadFull(r, name); err != nil {
+		return nil, err
+	}
+	h.name = strings.TrimRight(string(name[:size]), "\x00")
+	return h, nil
+}
+
+// skipCPIOPadding skips NUL bytes that pad an archive to a block boundary.
+func skipCPIOPadding(br *bufio.Reader) error {
+	for {
+		b, err := br.Peek(1)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if b[0] != 0 {
+			return nil
+		}
+		if _, err := br.Discard(1); err != nil {
+			return err
+		}
+	}
+}
+
+// padTo returns the padding needed to align n to a multiple of align.
+func padTo(n, align int64) int64 {
+	return (align - n%align) % align
+}
+
+// unixMode converts Unix file mode bits to an fs.FileMode.
+func unixMode(m int64) fs.FileMode {
+	mode := fs.FileMode(m).Perm()
+	switch m & 0170000 {
+	case 0040000:
+		mode |= fs.ModeDir
+	case 0120000:
+		mode |= fs.ModeSymlink
+	case 0020000:
+		mode |= fs.ModeDevice | fs.ModeCharDevice
+	case 0060000:
+		mode |= fs.ModeDevice
+	case 0010000:
+		mode |= fs.ModeNamedPipe
+	case 0140000:
+		mode |= fs.ModeSocket
+	}
+	if m&04000 != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if m&02000 != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if m&01000 != 0 {
+		mode |= fs.ModeSticky
+	}
+	return mode
+}
+
+type cpioFileInfo struct {
+	name  string
+	size  int64
+	mode  fs.FileMode
+	mtime time.Time
+}
+
+func (fi *cpioFileInfo) Name() string       { return path.Base(fi.name) }
+func (fi *cpioFileInfo) Size() int64        { return fi.size }
+func (fi *cpioFileInfo) Mode() fs.FileMode  { return fi.mode }
+func (fi *cpioFileInfo) ModTime() time.Time { return fi.mtime }
+func (fi *cpioFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *cpioFileInfo) Sys() interface{}   { return nil }
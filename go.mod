@@ -3,7 +3,22 @@ module github.com/sclevine/ztgrep
 go 1.17
 
 require (
-	github.com/jessevdk/go-flags v1.5.0 // indirect
-	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c // indirect
-	golang.org/x/sys v0.0.0-20210320140829-1e4c9ba3b0c4 // indirect
+	github.com/andybalholm/brotli v1.0.5
+	github.com/bodgit/sevenzip v1.4.3
+	github.com/jessevdk/go-flags v1.5.0
+	github.com/klauspost/compress v1.16.6
+	github.com/nwaples/rardecode/v2 v2.0.1
+	github.com/pierrec/lz4/v4 v4.1.18
+	github.com/ulikunitz/xz v0.5.12
+	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
+)
+
+require (
+	github.com/bodgit/plumbing v1.3.0 // indirect
+	github.com/bodgit/windows v1.0.1 // indirect
+	github.com/hashicorp/errwrap v1.0.0 // indirect
+	github.com/hashicorp/go-multierror v1.1.1 // indirect
+	go4.org v0.0.0-20200411211856-f5505b9728dd // indirect
+	golang.org/x/sys v0.5.0 // indirect
+	golang.org/x/text v0.10.0 // indirect
 )
@@ -0,0 +1,442 @@
+package ztgrep
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	dockerManifestFile = "manifest.json"
+	ociIndexFile       = "index.json"
+	ociLayoutFile      = "oci-layout"
+
+	ociRefNameAnnotation      = "org.opencontainers.image.ref.name"
+	containerdImageAnnotation = "io.containerd.image.name"
+	dockerReferenceAnnotation = "vnd.docker.reference.type"
+	maxImageSymlinks          = 8
+	maxImageDepth             = 8
+
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// imageTarReader searches a tar file as a Docker or OCI image, if it contains a manifest.
+// Other tar files, and tar files too large to index without zt.Spill, are searched normally.
+func (zt *ZTgrep) imageTarReader(r io.Reader, fn func(string, fs.FileInfo, io.Reader) error) error {
+	ra, n, closer, err := zt.readerAt(r)
+	if tle, ok := err.(tooLargeError); ok {
+		return tarReader(tle, fn)
+	}
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	tfs, err := indexTar(ra, n)
+	if err != nil {
+		return err
+	}
+	images, err := readImages(tfs)
+	if err != nil {
+		return err
+	}
+	if images == nil {
+		return tarReader(io.NewSectionReader(ra, 0, n), fn)
+	}
+	return zt.searchImages(tfs, images, fn)
+}
+
+// imageDirReader returns an extractor for an OCI image layout directory.
+func (zt *ZTgrep) imageDirReader(dir string) extractor {
+	return func(_ io.Reader, fn func(string, fs.FileInfo, io.Reader) error) error {
+		images, err := readImages(imageDir(dir))
+		if err != nil {
+			return err
+		}
+		if images == nil {
+			return fmt.Errorf("%s: not an OCI image layout", dir)
+		}
+		return zt.searchImages(imageDir(dir), images, fn)
+	}
+}
+
+// isImageDir returns true if dir is an OCI image layout.
+func isImageDir(dir string) bool {
+	fi, err := os.Stat(filepath.Join(dir, ociLayoutFile))
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// searchImages calls fn for each image, which calls fn for each layer.
+// If zt.MergeLayers is set, only files that are visible in the final filesystem of each image are searched.
+func (zt *ZTgrep) searchImages(ifs imageFS, images []image, fn func(string, fs.FileInfo, io.Reader) error) error {
+	for _, img := range images {
+		img := img
+		if err := fn(img.ref, nil, archiveReader{
+			Reader: strings.NewReader(""),
+			xf: func(_ io.Reader, fn func(string, fs.FileInfo, io.Reader) error) error {
+				var merged map[string]int
+				if zt.MergeLayers {
+					var err error
+					if merged, err = zt.mergeLayers(ifs, img.layers); err != nil {
+						return err
+					}
+				}
+				for i, l := range img.layers {
+					xf := tarReader
+					if merged != nil {
+						xf = mergedLayerReader(merged, i)
+					}
+					if err := searchLayer(ifs, l, xf, fn); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func searchLayer(ifs imageFS, l layer, xf extractor, fn func(string, fs.FileInfo, io.Reader) error) error {
+	f, err := ifs.Open(l.path)
+	if errors.Is(err, fs.ErrNotExist) && l.foreign {
+		return nil // not distributed with the image
+	} else if err != nil {
+		return fmt.Errorf("layer %s: %w", l.digest, err)
+	}
+	defer f.Close()
+	return fn(l.digest, nil, archiveReader{Reader: f, xf: xf})
+}
+
+// mergedLayerReader returns an extractor for layer i that skips files hidden or replaced by other layers.
+func mergedLayerReader(merged map[string]int, i int) extractor {
+	return func(r io.Reader, fn func(string, fs.FileInfo, io.Reader) error) error {
+		return tarReader(r, func(name string, fi fs.FileInfo, r io.Reader) error {
+			if layer, ok := merged[layerPath(name)]; !ok || layer != i {
+				return nil
+			}
+			return fn(name, fi, r)
+		})
+	}
+}
+
+// mergeLayers returns the index of the layer that provides each file in the final filesystem of an image,
+// applying whiteouts and replacements from each layer to the layers below it.
+func (zt *ZTgrep) mergeLayers(ifs imageFS, layers []layer) (map[string]int, error) {
+	merged := map[string]int{}
+	dirs := map[string]bool{}
+	removeChildren := func(dir string) {
+		prefix := dir + "/"
+		if dir == "" {
+			prefix = ""
+		}
+		for name := range merged {
+			if strings.HasPrefix(name, prefix) {
+				delete(merged, name)
+			}
+		}
+	}
+	for i, l := range layers {
+		type entry struct {
+			name string
+			dir  bool
+		}
+		var entries []entry
+		err := zt.readLayer(ifs, l, func(name string, fi fs.FileInfo, _ io.Reader) error {
+			p := layerPath(name)
+			dir, base := path.Split(p)
+			dir = strings.TrimSuffix(dir, "/")
+			switch {
+			case base == whiteoutOpaque:
+				removeChildren(dir)
+			case strings.HasPrefix(base, whiteoutPrefix):
+				p := path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+				delete(merged, p)
+				removeChildren(p)
+			default:
+				entries = append(entries, entry{p, fi.IsDir()})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("layer %s: %w", l.digest, err)
+		}
+		// whiteouts only apply to lower layers, so entries are added after all whiteouts are applied
+		for _, e := range entries {
+			if !e.dir && dirs[e.name] {
+				removeChildren(e.name)
+			}
+			merged[e.name] = i
+			dirs[e.name] = e.dir
+		}
+	}
+	return merged, nil
+}
+
+// readLayer calls fn for each file in a layer, without searching it.
+func (zt *ZTgrep) readLayer(ifs imageFS, l layer, fn func(string, fs.FileInfo, io.Reader) error) error {
+	f, err := ifs.Open(l.path)
+	if errors.Is(err, fs.ErrNotExist) && l.foreign {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, hdr := peekHeader(f)
+	if zf, _ := zt.magicDecompressor(hdr); zf != nil {
+		// layers are only read from image files, which are closed when the search is canceled
+		rc, err := zf(context.Background(), r)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		r = rc
+	}
+	return tarReader(r, fn)
+}
+
+// layerPath returns the path of a file in a layer, relative to the root of the filesystem.
+func layerPath(name string) string {
+	return path.Clean("/" + name)[1:]
+}
+
+type image struct {
+	ref    string
+	layers []layer
+}
+
+type layer struct {
+	digest  string
+	path    string
+	foreign bool
+}
+
+// readImages reads the images listed in a Docker manifest.json or OCI index.json.
+// If neither is present or valid, readImages returns nil.
+func readImages(ifs imageFS) ([]image, error) {
+	var manifest []dockerManifest
+	if ok, _ := readImageJSON(ifs, dockerManifestFile, &manifest); ok && isDockerManifest(manifest) {
+		images := []image{}
+		for _, m := range manifest {
+			var config struct {
+				RootFS struct {
+					DiffIDs []string `json:"diff_ids"`
+				} `json:"rootfs"`
+			}
+			if _, err := readImageJSON(ifs, m.Config, &config); err != nil {
+				return nil, err
+			}
+			img := image{ref: blobDigest(m.Config)}
+			if len(m.RepoTags) > 0 {
+				img.ref = m.RepoTags[0]
+			}
+			for i, p := range m.Layers {
+				l := layer{digest: blobDigest(p), path: p}
+				if l.digest == p && i < len(config.RootFS.DiffIDs) {
+					l.digest = config.RootFS.DiffIDs[i]
+				}
+				_, l.foreign = m.LayerSources[l.digest]
+				img.layers = append(img.layers, l)
+			}
+			images = append(images, img)
+		}
+		return images, nil
+	}
+
+	var index ociManifest
+	if ok, _ := readImageJSON(ifs, ociIndexFile, &index); !ok || index.Manifests == nil {
+		return nil, nil
+	}
+	images := []image{}
+	for _, desc := range index.Manifests {
+		ref := desc.Annotations[containerdImageAnnotation]
+		if ref == "" {
+			ref = desc.Annotations[ociRefNameAnnotation]
+		}
+		if ref == "" {
+			ref = desc.Digest
+		}
+		imgs, err := readOCIManifest(ifs, ref, desc, 0)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, imgs...)
+	}
+	return images, nil
+}
+
+type dockerManifest struct {
+	Config       string
+	RepoTags     []string
+	Layers       []string
+	LayerSources map[string]json.RawMessage
+}
+
+func isDockerManifest(manifest []dockerManifest) bool {
+	for _, m := range manifest {
+		if m.Config == "" {
+			return false
+		}
+	}
+	return len(manifest) > 0
+}
+
+type ociManifest struct {
+	Manifests []ociDescriptor `json:"manifests"`
+	Layers    []ociDescriptor `json:"layers"`
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// readOCIManifest reads an image manifest or a nested image index.
+// Images in a nested index are identified by ref followed by the digest of their manifest.
+func readOCIManifest(ifs imageFS, ref string, desc ociDescriptor, depth int) ([]image, error) {
+	if depth > maxImageDepth {
+		return nil, errors.New("image index nested too deeply")
+	}
+	var m ociManifest
+	if ok, err := readImageJSON(ifs, blobPath(desc.Digest), &m); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, fmt.Errorf("manifest %s: %w", desc.Digest, fs.ErrNotExist)
+	}
+	if m.Manifests != nil {
+		var images []image
+		for _, d := range m.Manifests {
+			if d.Annotations[dockerReferenceAnnotation] != "" {
+				continue // attestations
+			}
+			imgs, err := readOCIManifest(ifs, strings.SplitN(ref, "@", 2)[0]+"@"+d.Digest, d, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			images = append(images, imgs...)
+		}
+		return images, nil
+	}
+	img := image{ref: ref}
+	for _, d := range m.Layers {
+		img.layers = append(img.layers, layer{
+			digest:  d.Digest,
+			path:    blobPath(d.Digest),
+			foreign: strings.Contains(d.MediaType, "foreign") || strings.Contains(d.MediaType, "nondistributable"),
+		})
+	}
+	return []image{img}, nil
+}
+
+// readImageJSON decodes the JSON file at name into v, returning false if it does not exist.
+func readImageJSON(ifs imageFS, name string, v interface{}) (bool, error) {
+	if name == "" {
+		return false, nil
+	}
+	f, err := ifs.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(v); err != nil {
+		return false, fmt.Errorf("%s: %w", name, err)
+	}
+	return true, nil
+}
+
+// blobPath returns the path of a blob in an OCI image layout.
+func blobPath(digest string) string {
+	return path.Join("blobs", strings.Replace(digest, ":", "/", 1))
+}
+
+// blobDigest returns the digest of a blob given its path, or the path if it is not a blob.
+func blobDigest(p string) string {
+	dir, hex := path.Split(path.Clean(p))
+	dir = strings.TrimSuffix(dir, "/")
+	if path.Base(path.Dir(dir)) == "blobs" {
+		return path.Base(dir) + ":" + hex
+	}
+	if dir == "" && strings.HasSuffix(hex, ".json") {
+		return "sha256:" + strings.TrimSuffix(hex, ".json") // legacy config
+	}
+	return p
+}
+
+// imageFS provides access to the files of an image tar file or OCI image layout directory.
+type imageFS interface {
+	Open(name string) (io.ReadCloser, error)
+}
+
+type imageDir string
+
+func (d imageDir) Open(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(string(d), filepath.FromSlash(path.Clean("/"+name))))
+}
+
+type imageTar struct {
+	ra    io.ReaderAt
+	files map[string]imageTarFile
+}
+
+type imageTarFile struct {
+	offset, size int64
+	link         string
+}
+
+// indexTar records the location of each file in a tar file.
+func indexTar(ra io.ReaderAt, n int64) (*imageTar, error) {
+	sr := io.NewSectionReader(ra, 0, n)
+	tr := tar.NewReader(sr)
+	t := &imageTar{ra: ra, files: map[string]imageTarFile{}}
+	for h, err := tr.Next(); err != io.EOF; h, err = tr.Next() {
+		if err != nil {
+			return nil, err
+		}
+		name := path.Clean("/" + h.Name)
+		switch h.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			offset, err := sr.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return nil, err
+			}
+			t.files[name] = imageTarFile{offset: offset, size: h.Size}
+		case tar.TypeSymlink:
+			link := h.Linkname
+			if !path.IsAbs(link) {
+				link = path.Join(path.Dir(name), link)
+			}
+			t.files[name] = imageTarFile{link: path.Clean(link)}
+		case tar.TypeLink:
+			t.files[name] = imageTarFile{link: path.Clean("/" + h.Linkname)}
+		}
+	}
+	return t, nil
+}
+
+func (t *imageTar) Open(name string) (io.ReadCloser, error) {
+	name = path.Clean("/" + name)
+	for i := 0; i < maxImageSymlinks; i++ {
+		f, ok := t.files[name]
+		if !ok {
+			return nil, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+		}
+		if f.link == "" {
+			return io.NopCloser(io.NewSectionReader(t.ra, f.offset, f.size)), nil
+		}
+		name = f.link
+	}
+	return nil, fmt.Errorf("%s: too many links", name)
+}
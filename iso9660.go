@@ -0,0 +1,364 @@
+package ztgrep
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	isoMagic      = "CD001"
+	isoSectorSize = 2048
+	isoMaxDepth   = 64
+
+	isoFlagDir         = 0x02
+	isoFlagMultiExtent = 0x80
+)
+
+var errISOHeader = errors.New("invalid iso9660 image")
+
+// isoReader calls fn for each file and directory in an ISO 9660 image.
+// Rock Ridge names and modes are preferred, followed by Joliet names.
+func (zt *ZTgrep) isoReader(r io.Reader, fn func(string, fs.FileInfo, io.Reader) error) error {
+	ra, n, closer, err := zt.readerAt(r)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	img := &isoImage{ra: ra, size: n, visited: map[uint32]bool{}}
+	root, err := img.readVolumes()
+	if err != nil {
+		return err
+	}
+	return img.walk("", root, 0, fn)
+}
+
+type isoImage struct {
+	ra      io.ReaderAt
+	size    int64
+	joliet  bool
+	susp    bool // Rock Ridge
+	skip    int  // bytes to skip in each system use area
+	visited map[uint32]bool
+}
+
+type isoRecord struct {
+	extent uint32
+	size   int64
+	flags  byte
+	name   string
+	mode   fs.FileMode
+	mtime  time.Time
+
+	relocated bool   // RE: directory moved elsewhere, listed through a CL entry
+	child     uint32 // CL: location of a relocated directory
+}
+
+// readVolumes reads the volume descriptors and returns the root directory.
+func (img *isoImage) readVolumes() (*isoRecord, error) {
+	var pvd, svd []byte
+	for sector := int64(16); ; sector++ {
+		vd := make([]byte, isoSectorSize)
+		if _, err := img.ra.ReadAt(vd, sector*isoSectorSize); err != nil {
+			return nil, err
+		}
+		if string(vd[1:6]) != isoMagic {
+			return nil, errISOHeader
+		}
+		switch vd[0] {
+		case 1:
+			if pvd == nil {
+				pvd = vd
+			}
+		case 2:
+			if esc := string(vd[88:91]); esc == "%/@" || esc == "%/C" || esc == "%/E" {
+				svd = vd
+			}
+		}
+		if vd[0] == 255 {
+			break
+		}
+	}
+	if pvd == nil {
+		return nil, errISOHeader
+	}
+	root, err := img.parseRecord(pvd[156:190])
+	if err != nil {
+		return nil, err
+	}
+	if err := img.detectRockRidge(root); err != nil {
+		return nil, err
+	}
+	if !img.susp && svd != nil {
+		img.joliet = true
+		return img.parseRecord(svd[156:190])
+	}
+	return root, nil
+}
+
+// detectRockRidge checks for an SP entry in the first record of the root directory.
+func (img *isoImage) detectRockRidge(root *isoRecord) error {
+	b := make([]byte, isoSectorSize)
+	if _, err := img.ra.ReadAt(b, int64(root.extent)*isoSectorSize); err != nil {
+		return err
+	}
+	n := int(b[0])
+	if n < 34 || n > len(b) {
+		return errISOHeader
+	}
+	sua := systemUseArea(b[:n])
+	if len(sua) >= 7 && string(sua[:2]) == "SP" && sua[4] == 0xbe && sua[5] == 0xef {
+		img.susp = true
+		img.skip = int(sua[6])
+	}
+	return nil
+}
+
+func (img *isoImage) walk(dir string, rec *isoRecord, depth int, fn func(string, fs.FileInfo, io.Reader) error) error {
+	if depth > isoMaxDepth || img.visited[rec.extent] {
+		return errors.New("iso9660 directory loop")
+	}
+	img.visited[rec.extent] = true
+	records, err := img.readDir(rec)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(records); i++ {
+		r := records[i]
+		if r.relocated {
+			continue
+		}
+		name := path.Join(dir, r.name)
+		if r.child != 0 {
+			if r, err = img.readSelf(r); err != nil {
+				return err
+			}
+		}
+		if r.flags&isoFlagDir != 0 {
+			if err := fn(name, isoFileInfo{r}, strings.NewReader("")); err != nil {
+				return err
+			}
+			if err := img.walk(name, r, depth+1, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		// multi-extent files are split across consecutive records
+		fr := []io.Reader{io.NewSectionReader(img.ra, int64(r.extent)*isoSectorSize, r.size)}
+		info := *r
+		for r.flags&isoFlagMultiExtent != 0 && i+1 < len(records) {
+			i++
+			r = records[i]
+			fr = append(fr, io.NewSectionReader(img.ra, int64(r.extent)*isoSectorSize, r.size))
+			info.size += r.size
+		}
+		if err := fn(name, isoFileInfo{&info}, io.MultiReader(fr...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSelf returns the relocated directory that a CL entry points to, using its "." record.
+func (img *isoImage) readSelf(r *isoRecord) (*isoRecord, error) {
+	b := make([]byte, isoSectorSize)
+	if _, err := img.ra.ReadAt(b, int64(r.child)*isoSectorSize); err != nil {
+		return nil, err
+	}
+	n := int(b[0])
+	if n < 34 || n > len(b) {
+		return nil, errISOHeader
+	}
+	self, err := img.parseRecord(b[:n])
+	if err != nil {
+		return nil, err
+	}
+	self.name, self.mtime = r.name, r.mtime
+	if r.mode != 0 {
+		self.mode = r.mode
+	}
+	return self, nil
+}
+
+// readDir returns the records in a directory, excluding "." and "..".
+func (img *isoImage) readDir(dir *isoRecord) ([]*isoRecord, error) {
+	if int64(dir.extent)*isoSectorSize+dir.size > img.size {
+		return nil, errISOHeader
+	}
+	b := make([]byte, dir.size)
+	if _, err := img.ra.ReadAt(b, int64(dir.extent)*isoSectorSize); err != nil {
+		return nil, err
+	}
+	var records []*isoRecord
+	for off := 0; off < len(b); {
+		n := int(b[off])
+		if n == 0 {
+			// records do not cross sector boundaries
+			off = (off/isoSectorSize + 1) * isoSectorSize
+			continue
+		}
+		if n < 34 || off+n > len(b) {
+			return nil, errISOHeader
+		}
+		rec, err := img.parseRecord(b[off : off+n])
+		if err != nil {
+			return nil, err
+		}
+		off += n
+		if rec.name == "\x00" || rec.name == "\x01" {
+			continue
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+func (img *isoImage) parseRecord(b []byte) (*isoRecord, error) {
+	if len(b) < 34 || 33+int(b[32]) > len(b) {
+		return nil, errISOHeader
+	}
+	nameLen := int(b[32])
+	rec := &isoRecord{
+		extent: binary.LittleEndian.Uint32(b[2:6]),
+		size:   int64(binary.LittleEndian.Uint32(b[10:14])),
+		flags:  b[25],
+		mtime:  isoTime(b[18:25]),
+	}
+	name := b[33 : 33+nameLen]
+	switch {
+	case nameLen == 1 && name[0] <= 1:
+		rec.name = string(name)
+	case img.joliet:
+		u := make([]uint16, nameLen/2)
+		for i := range u {
+			u[i] = binary.BigEndian.Uint16(name[2*i:])
+		}
+		rec.name = isoName(string(utf16.Decode(u)))
+	default:
+		rec.name = isoName(string(name))
+	}
+	if sua := systemUseArea(b); img.susp && len(sua) > img.skip {
+		if err := img.parseSystemUse(rec, sua[img.skip:]); err != nil {
+			return nil, err
+		}
+	}
+	return rec, nil
+}
+
+// systemUseArea returns the system use area of a directory record.
+func systemUseArea(b []byte) []byte {
+	off := 33 + int(b[32])
+	if off%2 != 0 {
+		off++
+	}
+	if off > len(b) {
+		return nil
+	}
+	return b[off:]
+}
+
+// parseSystemUse applies Rock Ridge entries to rec, following continuation areas.
+func (img *isoImage) parseSystemUse(rec *isoRecord, b []byte) error {
+	var name, next []byte
+	hasName := false
+	for areas := 0; ; {
+		if len(b) < 4 {
+			if next == nil {
+				break
+			}
+			b, next = next, nil
+			continue
+		}
+		n := int(b[2])
+		if n < 4 || n > len(b) {
+			b = nil
+			continue
+		}
+		e := b[:n]
+		b = b[n:]
+		switch string(e[:2]) {
+		case "NM":
+			if n >= 5 && e[4]&0x6 == 0 { // not "." or ".."
+				name = append(name, e[5:]...)
+				hasName = true
+			}
+		case "PX":
+			if n >= 12 {
+				rec.mode = unixMode(int64(binary.LittleEndian.Uint32(e[4:8])))
+			}
+		case "RE":
+			rec.relocated = true
+		case "CL":
+			if n >= 12 {
+				rec.child = binary.LittleEndian.Uint32(e[4:8])
+				rec.flags |= isoFlagDir
+			}
+		case "CE":
+			if n < 28 || areas >= isoMaxDepth {
+				continue
+			}
+			areas++
+			block := int64(binary.LittleEndian.Uint32(e[4:8]))
+			off := int64(binary.LittleEndian.Uint32(e[12:16]))
+			size := binary.LittleEndian.Uint32(e[20:24])
+			if off+int64(size) > isoSectorSize {
+				return errISOHeader
+			}
+			next = make([]byte, size)
+			if _, err := img.ra.ReadAt(next, block*isoSectorSize+off); err != nil {
+				return err
+			}
+		case "ST":
+			b = nil
+		}
+	}
+	if hasName {
+		rec.name = string(name)
+	}
+	return nil
+}
+
+// isoName removes the version number and trailing dot from an ISO 9660 file name.
+func isoName(name string) string {
+	if i := strings.LastIndexByte(name, ';'); i >= 0 {
+		name = name[:i]
+	}
+	if len(name) > 1 {
+		name = strings.TrimSuffix(name, ".")
+	}
+	return name
+}
+
+func isoTime(b []byte) time.Time {
+	if b[0] == 0 && b[1] == 0 {
+		return time.Time{}
+	}
+	zone := time.FixedZone("", int(int8(b[6]))*15*60)
+	return time.Date(1900+int(b[0]), time.Month(b[1]), int(b[2]), int(b[3]), int(b[4]), int(b[5]), 0, zone)
+}
+
+type isoFileInfo struct {
+	r *isoRecord
+}
+
+func (fi isoFileInfo) Name() string       { return path.Base(fi.r.name) }
+func (fi isoFileInfo) Size() int64        { return fi.r.size }
+func (fi isoFileInfo) ModTime() time.Time { return fi.r.mtime }
+func (fi isoFileInfo) IsDir() bool        { return fi.r.flags&isoFlagDir != 0 }
+func (fi isoFileInfo) Sys() interface{}   { return nil }
+
+func (fi isoFileInfo) Mode() fs.FileMode {
+	switch {
+	case fi.r.mode != 0:
+		return fi.r.mode
+	case fi.IsDir():
+		return fs.ModeDir | 0555
+	default:
+		return 0444
+	}
+}
@@ -0,0 +1,130 @@
+package ztgrep
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/ulikunitz/xz/lzma"
+)
+
+const (
+	lzipMagic       = "LZIP"
+	lzipHeaderSize  = 6
+	lzipTrailerSize = 20
+)
+
+var errLzipHeader = errors.New("invalid lzip header")
+
+// lzipReader decompresses an lzip file, which may contain multiple members.
+func lzipReader(_ context.Context, r io.Reader) (io.ReadCloser, error) {
+	lr := &lzipMemberReader{br: bufio.NewReader(r)}
+	if err := lr.next(); err != nil {
+		return nil, err
+	}
+	return io.NopCloser(lr), nil
+}
+
+type lzipMemberReader struct {
+	br    *bufio.Reader
+	lr    *lzma.Reader
+	crc   hash.Hash32
+	size  int64 // uncompressed size of the current member
+	count int64 // compressed size of the current member
+}
+
+// next reads the header of the next member.
+func (r *lzipMemberReader) next() error {
+	hdr := make([]byte, lzipHeaderSize)
+	_, err := io.ReadFull(r.br, hdr)
+	if err != nil {
+		return err
+	}
+	if string(hdr[:4]) != lzipMagic || hdr[4] != 1 {
+		return errLzipHeader
+	}
+	dictSize := uint32(1) << (hdr[5] & 0x1f)
+	dictSize -= dictSize / 16 * uint32(hdr[5]>>5)
+
+	// lzip members are LZMA streams with fixed properties and an end marker
+	lzmaHdr := make([]byte, lzma.HeaderLen)
+	lzmaHdr[0] = 0x5d // lc=3, lp=0, pb=2
+	binary.LittleEndian.PutUint32(lzmaHdr[1:], dictSize)
+	binary.LittleEndian.PutUint64(lzmaHdr[5:], ^uint64(0))
+	r.crc, r.size, r.count = crc32.NewIEEE(), 0, 0
+	r.lr, err = lzma.NewReader(&prefixByteReader{prefix: lzmaHdr, br: countByteReader{r.br, &r.count}})
+	return err
+}
+
+func (r *lzipMemberReader) Read(p []byte) (int, error) {
+	n, err := r.lr.Read(p)
+	r.crc.Write(p[:n])
+	r.size += int64(n)
+	if err != io.EOF {
+		return n, err
+	}
+	var trailer struct {
+		CRC        uint32
+		DataSize   uint64
+		MemberSize uint64
+	}
+	if err := binary.Read(r.br, binary.LittleEndian, &trailer); err != nil {
+		return n, err
+	}
+	if trailer.CRC != r.crc.Sum32() || trailer.DataSize != uint64(r.size) ||
+		trailer.MemberSize != uint64(lzipHeaderSize+r.count+lzipTrailerSize) {
+		return n, errors.New("lzip: invalid checksum")
+	}
+	if magic, _ := r.br.Peek(len(lzipMagic)); string(magic) != lzipMagic {
+		return n, io.EOF // ignore trailing data
+	}
+	if err := r.next(); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+// prefixByteReader reads prefix, followed by br.
+type prefixByteReader struct {
+	prefix []byte
+	br     io.ByteReader
+}
+
+func (r *prefixByteReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	p[0] = b
+	return 1, nil
+}
+
+func (r *prefixByteReader) ReadByte() (byte, error) {
+	if len(r.prefix) > 0 {
+		b := r.prefix[0]
+		r.prefix = r.prefix[1:]
+		return b, nil
+	}
+	return r.br.ReadByte()
+}
+
+// countByteReader counts bytes read from br.
+type countByteReader struct {
+	br *bufio.Reader
+	n  *int64
+}
+
+func (r countByteReader) ReadByte() (byte, error) {
+	b, err := r.br.ReadByte()
+	if err == nil {
+		*r.n++
+	}
+	return b, err
+}
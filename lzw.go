@@ -0,0 +1,171 @@
+package ztgrep
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+)
+
+const (
+	lzwMagic     = "\x1f\x9d"
+	lzwClear     = 256
+	lzwBlockMode = 0x80
+	lzwMaxBits   = 0x1f
+)
+
+var errLZW = errors.New("invalid lzw code")
+
+// lzwReader decompresses a file created by Unix compress (.Z).
+// The LZW variant used by compress differs from compress/lzw: code widths grow to a configurable maximum,
+// and codes are written in groups of eight that are discarded when the code width changes.
+func lzwReader(_ context.Context, r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	hdr := make([]byte, 3)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, err
+	}
+	max := uint(hdr[2] & lzwMaxBits)
+	if string(hdr[:2]) != lzwMagic || max < 9 || max > 16 {
+		return nil, errors.New("invalid compress header")
+	}
+	d := &lzwDecoder{
+		br:     br,
+		block:  hdr[2]&lzwBlockMode != 0,
+		max:    max,
+		bits:   9,
+		mask:   0x1ff,
+		end:    255,
+		prev:   -1,
+		prefix: make([]uint16, 1<<max),
+		suffix: make([]byte, 1<<max),
+	}
+	if d.block {
+		d.end = lzwClear
+	}
+	return io.NopCloser(d), nil
+}
+
+type lzwDecoder struct {
+	br    *bufio.Reader
+	block bool
+	max   uint
+	bits  uint
+	mask  int
+	end   int // last code in the table
+
+	chunk int    // bytes left in the current group of codes
+	rem   uint32 // bits left over from the last byte
+	left  uint   // number of bits in rem
+
+	prev, final int
+	prefix      []uint16
+	suffix      []byte
+	stack       []byte // string of the last code, reversed until complete
+	out         []byte
+	err         error
+}
+
+func (d *lzwDecoder) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		d.err = d.decode()
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+// decode reads one code and appends its string to d.out.
+func (d *lzwDecoder) decode() error {
+	if d.end >= d.mask && d.bits < d.max {
+		if err := d.flush(); err != nil {
+			return err
+		}
+		d.bits++
+		d.mask = d.mask<<1 | 1
+	}
+	code, err := d.readCode()
+	if err != nil {
+		return err
+	}
+	if d.prev < 0 {
+		if code > 255 {
+			return errLZW
+		}
+		d.prev, d.final = code, code
+		d.out = append(d.stack[:0], byte(code))
+		return nil
+	}
+	if code == lzwClear && d.block {
+		if err := d.flush(); err != nil {
+			return err
+		}
+		d.bits, d.mask, d.end = 9, 0x1ff, 255
+		return nil
+	}
+
+	in := code
+	d.stack = d.stack[:0]
+	if code > d.end {
+		if code != d.end+1 || d.prev > d.end {
+			return errLZW
+		}
+		d.stack = append(d.stack, byte(d.final))
+		code = d.prev
+	}
+	for code >= 256 {
+		d.stack = append(d.stack, d.suffix[code])
+		code = int(d.prefix[code])
+	}
+	d.stack = append(d.stack, byte(code))
+	d.final = code
+	if d.end < d.mask {
+		d.end++
+		d.prefix[d.end] = uint16(d.prev)
+		d.suffix[d.end] = byte(d.final)
+	}
+	d.prev = in
+
+	for i, j := 0, len(d.stack)-1; i < j; i, j = i+1, j-1 {
+		d.stack[i], d.stack[j] = d.stack[j], d.stack[i]
+	}
+	d.out = d.stack
+	return nil
+}
+
+// readCode reads a code of d.bits bits.
+// An incomplete code at the end of the input is treated as the end of the stream.
+func (d *lzwDecoder) readCode() (int, error) {
+	if d.chunk == 0 {
+		d.chunk = int(d.bits)
+	}
+	code := d.rem
+	for d.left < d.bits {
+		b, err := d.br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		code |= uint32(b) << d.left
+		d.left += 8
+		d.chunk--
+	}
+	d.left -= d.bits
+	d.rem = code >> d.bits
+	return int(code) & d.mask, nil
+}
+
+// flush discards the rest of the current group of codes.
+func (d *lzwDecoder) flush() error {
+	d.rem, d.left = 0, 0
+	if d.chunk > 0 {
+		n := d.chunk
+		d.chunk = 0
+		if _, err := d.br.Discard(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package ztgrep
+
+import (
+	"io"
+	"io/fs"
+	"path"
+	"time"
+
+	"github.com/nwaples/rardecode/v2"
+)
+
+func rarReader(r io.Reader, fn func(string, fs.FileInfo, io.Reader) error) error {
+	rr, err := rardecode.NewReader(r)
+	if err != nil {
+		return err
+	}
+	for h, err := rr.Next(); err != io.EOF; h, err = rr.Next() {
+		if err != nil {
+			return err
+		}
+		if err := fn(h.Name, rarFileInfo{h}, rr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type rarFileInfo struct {
+	h *rardecode.FileHeader
+}
+
+func (fi rarFileInfo) Name() string       { return path.Base(fi.h.Name) }
+func (fi rarFileInfo) Size() int64        { return fi.h.UnPackedSize }
+func (fi rarFileInfo) Mode() fs.FileMode  { return fi.h.Mode() }
+func (fi rarFileInfo) ModTime() time.Time { return fi.h.ModificationTime }
+func (fi rarFileInfo) IsDir() bool        { return fi.h.IsDir }
+func (fi rarFileInfo) Sys() interface{}   { return fi.h }
@@ -0,0 +1,101 @@
+package ztgrep
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	rpmMagic          = "\xed\xab\xee\xdb"
+	rpmHeaderMagic    = "\x8e\xad\xe8\x01"
+	rpmLeadSize       = 96
+	rpmTagPayloadComp = 1125
+	rpmTypeString     = 6
+
+	// limits enforced by rpm itself
+	rpmMaxTags     = 0xffff
+	rpmMaxDataSize = 0x0fffffff
+)
+
+var errRPMHeader = errors.New("invalid rpm header")
+
+// rpmReader skips the lead, signature, and header of an RPM package and decompresses its cpio payload.
+func (zt *ZTgrep) rpmReader(ctx context.Context, r io.Reader) (io.ReadCloser, error) {
+	lead := make([]byte, rpmLeadSize)
+	if _, err := io.ReadFull(r, lead); err != nil {
+		return nil, err
+	}
+	if string(lead[:4]) != rpmMagic {
+		return nil, errors.New("invalid rpm package")
+	}
+	if _, err := readRPMHeader(r, true); err != nil {
+		return nil, fmt.Errorf("rpm signature: %w", err)
+	}
+	tags, err := readRPMHeader(r, false)
+	if err != nil {
+		return nil, err
+	}
+	switch comp := tags[rpmTagPayloadComp]; comp {
+	case "", "gzip":
+		return gzReader(ctx, r)
+	case "bzip2":
+		return bz2Reader(ctx, r)
+	case "xz":
+		return zt.xzReader(ctx, r)
+	case "lzma":
+		return lzmaReader(ctx, r)
+	case "zstd":
+		return zt.zstReader(ctx, r)
+	default:
+		return nil, fmt.Errorf("unsupported rpm payload compressor %q", comp)
+	}
+}
+
+// readRPMHeader reads a header structure and returns its string tags.
+// The signature header is padded to a multiple of 8 bytes.
+func readRPMHeader(r io.Reader, pad bool) (map[int32]string, error) {
+	var h struct {
+		Magic    [4]byte
+		Reserved [4]byte
+		Count    int32
+		Size     int32
+	}
+	if err := binary.Read(r, binary.BigEndian, &h); err != nil {
+		return nil, err
+	}
+	if string(h.Magic[:]) != rpmHeaderMagic || h.Count < 0 || h.Count > rpmMaxTags || h.Size < 0 || h.Size > rpmMaxDataSize {
+		return nil, errRPMHeader
+	}
+	index := make([]struct{ Tag, Type, Offset, Count int32 }, h.Count)
+	if err := binary.Read(r, binary.BigEndian, index); err != nil {
+		return nil, err
+	}
+	size := int64(h.Size)
+	if pad {
+		size += (8 - size%8) % 8
+	}
+	store := make([]byte, size)
+	if _, err := io.ReadFull(r, store); err != nil {
+		return nil, err
+	}
+	data := store[:h.Size]
+	tags := map[int32]string{}
+	for _, e := range index {
+		if e.Type != rpmTypeString {
+			continue
+		}
+		if e.Offset < 0 || int64(e.Offset) >= int64(len(data)) {
+			return nil, errRPMHeader
+		}
+		s := data[e.Offset:]
+		if i := bytes.IndexByte(s, 0); i >= 0 {
+			s = s[:i]
+		}
+		tags[e.Tag] = string(s)
+	}
+	return tags, nil
+}
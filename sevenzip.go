@@ -0,0 +1,32 @@
+package ztgrep
+
+import (
+	"io"
+	"io/fs"
+
+	"github.com/bodgit/sevenzip"
+)
+
+func (zt *ZTgrep) sevenZipReader(r io.Reader, fn func(string, fs.FileInfo, io.Reader) error) error {
+	ra, n, closer, err := zt.readerAt(r)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	sr, err := sevenzip.NewReader(ra, n)
+	if err != nil {
+		return err
+	}
+	for _, file := range sr.File {
+		fr, err := file.Open()
+		if err != nil {
+			return err
+		}
+		err = fn(file.Name, file.FileInfo(), fr)
+		fr.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
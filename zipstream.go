@@ -0,0 +1,188 @@
+package ztgrep
+
+import (
+	"archive/zip"
+	"bufio"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+)
+
+const (
+	zipLocalHeaderSig     = 0x04034b50
+	zipCentralHeaderSig   = 0x02014b50
+	zipEndSig             = 0x06054b50
+	zipArchiveExtraSig    = 0x08064b50
+	zipDataDescriptorSig  = 0x08074b50
+	zipFlagEncrypted      = 0x1
+	zipFlagDataDescriptor = 0x8
+	zip64ExtraID          = 0x0001
+)
+
+var errZipStream = errors.New("zip file cannot be streamed")
+
+// streamZip calls fn for each file in a zip file by reading local file headers, without the central directory.
+// It returns the number of files passed to fn, so that a caller may resume from the central directory on error.
+func streamZip(r io.Reader, fn func(string, fs.FileInfo, io.Reader) error) (n int, err error) {
+	br := bufio.NewReader(r)
+	for ; ; n++ {
+		var sig uint32
+		if err := binary.Read(br, binary.LittleEndian, &sig); err != nil {
+			return n, err
+		}
+		switch sig {
+		case zipLocalHeaderSig:
+		case zipCentralHeaderSig, zipEndSig, zipArchiveExtraSig:
+			return n, nil
+		default:
+			return n, errZipStream
+		}
+		fh, zip64, err := readZipLocalHeader(br)
+		if err != nil {
+			return n, err
+		}
+		if fh.Flags&zipFlagEncrypted != 0 {
+			return n, errZipStream
+		}
+		descriptor := fh.Flags&zipFlagDataDescriptor != 0
+
+		var fr io.ReadCloser
+		switch fh.Method {
+		case zip.Store:
+			if descriptor && fh.CompressedSize64 == 0 {
+				return n, errZipStream
+			}
+			fr = io.NopCloser(io.LimitReader(br, int64(fh.CompressedSize64)))
+		case zip.Deflate:
+			// br implements io.ByteReader, so flate does not read past the compressed data
+			fr = flate.NewReader(br)
+		default:
+			return n, errZipStream
+		}
+		if err := fn(fh.Name, fh.FileInfo(), fr); err != nil {
+			return n + 1, err
+		}
+		_, err = io.Copy(io.Discard, fr)
+		fr.Close()
+		if err != nil {
+			return n + 1, err
+		}
+		if descriptor {
+			if err := skipZipDataDescriptor(br, zip64); err != nil {
+				return n + 1, err
+			}
+		}
+	}
+}
+
+func readZipLocalHeader(r io.Reader) (fh *zip.FileHeader, zip64 bool, err error) {
+	var h struct {
+		ReaderVersion    uint16
+		Flags            uint16
+		Method           uint16
+		ModifiedTime     uint16
+		ModifiedDate     uint16
+		CRC32            uint32
+		CompressedSize   uint32
+		UncompressedSize uint32
+		NameLen          uint16
+		ExtraLen         uint16
+	}
+	if err := binary.Read(r, binary.LittleEndian, &h); err != nil {
+		return nil, false, err
+	}
+	b := make([]byte, int(h.NameLen)+int(h.ExtraLen))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, false, err
+	}
+	fh = &zip.FileHeader{
+		Name:               string(b[:h.NameLen]),
+		ReaderVersion:      h.ReaderVersion,
+		Flags:              h.Flags,
+		Method:             h.Method,
+		ModifiedTime:       h.ModifiedTime,
+		ModifiedDate:       h.ModifiedDate,
+		CRC32:              h.CRC32,
+		CompressedSize64:   uint64(h.CompressedSize),
+		UncompressedSize64: uint64(h.UncompressedSize),
+		Extra:              b[h.NameLen:],
+	}
+	for extra := fh.Extra; len(extra) >= 4; {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		extra = extra[4:]
+		if size > len(extra) {
+			break
+		}
+		if id == zip64ExtraID {
+			zip64 = true
+			field := extra[:size]
+			if h.UncompressedSize == ^uint32(0) && len(field) >= 8 {
+				fh.UncompressedSize64 = binary.LittleEndian.Uint64(field)
+				field = field[8:]
+			}
+			if h.CompressedSize == ^uint32(0) && len(field) >= 8 {
+				fh.CompressedSize64 = binary.LittleEndian.Uint64(field)
+			}
+		}
+		extra = extra[size:]
+	}
+	return fh, zip64, nil
+}
+
+// skipZipDataDescriptor skips a data descriptor, which may or may not start with a signature.
+func skipZipDataDescriptor(r io.Reader, zip64 bool) error {
+	var sig uint32
+	if err := binary.Read(r, binary.LittleEndian, &sig); err != nil {
+		return err
+	}
+	n := int64(8) // sizes
+	if zip64 {
+		n = 16
+	}
+	if sig == zipDataDescriptorSig {
+		n += 4 // CRC-32
+	}
+	_, err := io.CopyN(io.Discard, r, n)
+	return err
+}
+
+// limitedBuffer buffers writes until more than max bytes are written.
+// If spill is set, writes are then moved to a temporary file, and write errors are recorded in err.
+type limitedBuffer struct {
+	buf      []byte
+	max      int64
+	overflow bool
+	spill    func() (*tempFile, error)
+	tf       *tempFile
+	err      error
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	switch {
+	case b.err != nil:
+	case b.tf != nil:
+		_, b.err = b.tf.Write(p)
+	case b.overflow:
+	case int64(len(b.buf)+len(p)) <= b.max:
+		b.buf = append(b.buf, p...)
+	case b.spill != nil:
+		if b.tf, b.err = b.spill(); b.err == nil {
+			_, b.err = b.tf.Write(append(b.buf, p...))
+		}
+		b.buf, b.overflow = nil, true
+	default:
+		b.buf, b.overflow = nil, true
+	}
+	return len(p), nil
+}
+
+// Close removes the temporary file, if any.
+func (b *limitedBuffer) Close() error {
+	if b.tf != nil {
+		return b.tf.Close()
+	}
+	return nil
+}
@@ -8,25 +8,39 @@ import (
 	"compress/bzip2"
 	"compress/gzip"
 	"context"
+	"encoding/binary"
 	"errors"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
 	"regexp"
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
 	"golang.org/x/sync/semaphore"
 )
 
-const defaultMaxZipSize = 10 << (10 * 2) // 10 MB
+const (
+	defaultMaxZipSize = 10 << (10 * 2) // 10 MB
+	headerSize        = 262            // covers tar magic at offset 257
+	maxReplaySize     = 1 << 20        // bytes retained to search misidentified files as plain files
+)
 
 var cpuLock = semaphore.NewWeighted(int64(runtime.NumCPU()))
 
-func acquireCPU() { cpuLock.Acquire(context.Background(), 1) }
-func releaseCPU() { cpuLock.Release(1) }
+func acquireCPU(ctx context.Context) error { return cpuLock.Acquire(ctx, 1) }
+func releaseCPU()                          { cpuLock.Release(1) }
 
 // New returns a *ZTgrep given a regular expression following https://golang.org/s/re2syntax
 func New(expr string) (*ZTgrep, error) {
@@ -34,56 +48,366 @@ func New(expr string) (*ZTgrep, error) {
 	if err != nil {
 		return nil, err
 	}
+	return newZTgrep(exp, exp), nil
+}
+
+// NewSplit returns a *ZTgrep that matches file names against nameExpr and file contents against bodyExpr.
+// Either expression may be empty to skip matching file names or contents.
+func NewSplit(nameExpr, bodyExpr string) (*ZTgrep, error) {
+	var nameExp, bodyExp *regexp.Regexp
+	var err error
+	if nameExpr != "" {
+		if nameExp, err = regexp.Compile(nameExpr); err != nil {
+			return nil, err
+		}
+	}
+	if bodyExpr != "" {
+		if bodyExp, err = regexp.Compile(bodyExpr); err != nil {
+			return nil, err
+		}
+	}
+	return newZTgrep(nameExp, bodyExp), nil
+}
+
+func newZTgrep(nameExp, bodyExp *regexp.Regexp) *ZTgrep {
 	return &ZTgrep{
-		MaxZipSize: defaultMaxZipSize,
-		exp:        exp,
-	}, nil
+		MaxZipSize:    defaultMaxZipSize,
+		StreamZip:     true,
+		PathSeparator: ":",
+		nameExp:       nameExp,
+		bodyExp:       bodyExp,
+	}
 }
 
 // ZTgrep searchs for file names and contents within nested compressed archives.
 type ZTgrep struct {
-	MaxZipSize int64 // maximum size of zip file to search (held in memory)
-	SkipName   bool  // skip file names
-	SkipBody   bool  // skip file contents
+	tempSize int64 // accessed atomically, first for 64-bit alignment
 
-	exp *regexp.Regexp
+	MaxZipSize int64  // maximum size of zip, 7z, or iso file to search (held in memory)
+	StreamZip  bool   // search zip files without holding them in memory, if possible
+	SkipName   bool   // skip file names
+	SkipBody   bool   // skip file contents
+	Detect     Detect // method used to identify compression and archive formats
+	Exec       bool   // decompress xz and zstd using the xz and zstd CLIs on $PATH
+	Lines      bool   // report each matching line in file contents
+	Before     int    // number of context lines to report before each matching line (implies Lines)
+	After      int    // number of context lines to report after each matching line (implies Lines)
+	Ordered    bool   // report results in the order of paths (buffered in memory)
+	MaxCount   int    // stop searching each path after this many matches
+
+	Recursive   bool     // search files within directories
+	FollowLinks bool     // follow symbolic links within directories
+	Include     []string // only search files within directories matching these globs
+	Exclude     []string // skip files and directories within directories matching these globs
+
+	EntryInclude []string // only search archive entries matching these globs (nested archives are still searched)
+	EntryExclude []string // skip archive entries matching these globs
+
+	RequireName   bool   // only search the contents of files with matching names, without reporting name matches
+	AllNames      bool   // also match top-level paths and the names of compressed files without compression extensions
+	PathMatch     bool   // match file names against the full nested path, including the top-level path
+	PathSeparator string // separator between nested paths for PathMatch (default ":")
+
+	Images      bool // search tar files and OCI layout directories as container images, by image and layer
+	MergeLayers bool // with Images, only search files that are visible in the final filesystem of each image
+
+	Spill       bool   // search zip, 7z, and iso files larger than MaxZipSize using temporary files
+	TempDir     string // directory for temporary files (default: os.TempDir())
+	MaxTempSize int64  // maximum total size of temporary files (0 for unlimited)
+
+	nameExp *regexp.Regexp
+	bodyExp *regexp.Regexp
 }
 
+// Detect specifies how compression and archive formats are identified.
+type Detect int
+
+const (
+	DetectBoth  Detect = iota // use file headers, falling back to file extensions
+	DetectExt                 // use file extensions only
+	DetectMagic               // use file headers only
+)
+
 // Result contains each matching path in Path.
 // Each entry in Path[1:] represents a file nested in the previous archive.
+// If ZTgrep.Lines is set, results for file contents contain the matching line.
+// If ZTgrep.Before or ZTgrep.After are set, non-matching lines near each match are reported with Context set.
 type Result struct {
-	Path []string
-	Err  error
+	Path    []string
+	Info    fs.FileInfo // metadata for the last file in Path, if available
+	Body    bool        // match is in file contents, rather than file name
+	Line    string      // matching line, without trailing newline
+	LineNum int         // 1-based line number of Line, or 0 if not a line match
+	Offset  int64       // byte offset of Line within the file
+	Context bool        // Line is context surrounding a matching line
+	Err     error
 }
 
 // Start searches paths in parallel, returning results via a channel
 func (zt *ZTgrep) Start(paths []string) <-chan Result {
+	return zt.StartContext(context.Background(), paths)
+}
+
+// StartContext searches paths in parallel, returning results via a channel.
+// When ctx is canceled, the search is aborted and the channel is closed.
+func (zt *ZTgrep) StartContext(ctx context.Context, paths []string) <-chan Result {
 	// TODO: restrict number of open files
-	// TODO: buffer output to guarantee order
-	out := make(chan Result)
+	in := make(chan Result)
 	wg := sync.WaitGroup{}
-	wg.Add(len(paths))
 	go func() {
+		prev := make(chan struct{})
+		close(prev)
+		for _, p := range paths {
+			zt.walkPath(ctx, p, func(p string, err error) {
+				if acquireCPU(ctx) != nil { // encourge ordered output
+					return
+				}
+				wg.Add(1)
+				pout := in
+				if zt.Ordered {
+					pout = make(chan Result)
+					next := make(chan struct{})
+					go forwardResults(in, bufferResults(pout), prev, next)
+					prev = next
+				}
+				go func() {
+					if err != nil {
+						pout <- Result{Path: []string{p}, Err: err}
+					} else {
+						zt.findPath(ctx, pout, p)
+					}
+					releaseCPU()
+					if zt.Ordered {
+						close(pout)
+					}
+					wg.Done()
+				}()
+			})
+		}
 		wg.Wait()
-		close(out)
+		<-prev
+		close(in)
 	}()
+	return cancelResults(ctx, in)
+}
+
+// cancelResults returns a channel that receives results from in until ctx is canceled.
+// After ctx is canceled, the channel is closed and remaining results from in are discarded.
+func cancelResults(ctx context.Context, in <-chan Result) <-chan Result {
+	out := make(chan Result)
 	go func() {
-		for _, p := range paths {
-			p := p
-			acquireCPU() // encourge ordered output
-			go func() {
-				zt.findPath(out, p)
-				releaseCPU()
-				wg.Done()
-			}()
+		defer close(out)
+		for {
+			select {
+			case res, ok := <-in:
+				if !ok {
+					return
+				}
+				if ctx.Err() != nil {
+					go drainResults(in)
+					return
+				}
+				select {
+				case out <- res:
+				case <-ctx.Done():
+					go drainResults(in)
+					return
+				}
+			case <-ctx.Done():
+				go drainResults(in)
+				return
+			}
+		}
+	}()
+	return out
+}
+
+func drainResults(in <-chan Result) {
+	for range in {
+	}
+}
+
+// bufferResults returns a channel that receives all results sent to in without blocking the sender.
+func bufferResults(in <-chan Result) <-chan Result {
+	out := make(chan Result)
+	go func() {
+		var buf []Result
+		for in != nil || len(buf) > 0 {
+			var send chan<- Result
+			var next Result
+			if len(buf) > 0 {
+				send, next = out, buf[0]
+			}
+			select {
+			case res, ok := <-in:
+				if !ok {
+					in = nil
+					continue
+				}
+				buf = append(buf, res)
+			case send <- next:
+				buf = buf[1:]
+			}
 		}
+		close(out)
 	}()
 	return out
 }
 
-func (zt *ZTgrep) findPath(out chan<- Result, path string) {
+// forwardResults sends results from in to out after prev is closed, then closes next.
+func forwardResults(out chan<- Result, in <-chan Result, prev <-chan struct{}, next chan<- struct{}) {
+	<-prev
+	for res := range in {
+		out <- res
+	}
+	close(next)
+}
+
+// walkPath calls fn for path, or for each file within path if path is a directory and zt.Recursive is set.
+func (zt *ZTgrep) walkPath(ctx context.Context, path string, fn func(string, error)) {
+	if !zt.Recursive || path == "-" {
+		fn(path, nil)
+		return
+	}
+	fi, err := os.Stat(path)
+	if err != nil || !fi.IsDir() || zt.Images && isImageDir(path) {
+		fn(path, nil)
+		return
+	}
+	zt.walkDir(ctx, path, map[string]bool{}, fn)
+}
+
+// walkDir calls fn for each file within dir.
+// Directories that are ancestors of themselves via symbolic links are skipped, while other directories
+// reachable by multiple paths are searched under each path.
+func (zt *ZTgrep) walkDir(ctx context.Context, dir string, ancestors map[string]bool, fn func(string, error)) {
+	if real, err := filepath.EvalSymlinks(dir); err == nil {
+		if ancestors[real] {
+			return
+		}
+		ancestors[real] = true
+		defer delete(ancestors, real)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		fn(dir, err)
+	}
+	for _, e := range entries {
+		if ctx.Err() != nil {
+			return
+		}
+		path := filepath.Join(dir, e.Name())
+		mode := e.Type()
+		if mode&fs.ModeSymlink != 0 {
+			if !zt.FollowLinks {
+				continue
+			}
+			fi, err := os.Stat(path)
+			if err != nil {
+				fn(path, err)
+				continue
+			}
+			mode = fi.Mode().Type()
+		}
+		name := filepath.ToSlash(path)
+		switch {
+		case mode.IsDir() && zt.Images && isImageDir(path):
+			if !excludeGlobs(zt.Include, zt.Exclude, name) {
+				fn(path, nil)
+			}
+		case mode.IsDir():
+			if !excludeGlobs(zt.Include, zt.Exclude, name) {
+				zt.walkDir(ctx, path, ancestors, fn)
+			}
+		case mode.IsRegular():
+			if includeGlobs(zt.Include, name) && !excludeGlobs(zt.Include, zt.Exclude, name) {
+				fn(path, nil)
+			}
+		}
+	}
+}
+
+// includeGlobs returns true if include is empty or any non-negated glob in include matches name.
+func includeGlobs(include []string, name string) bool {
+	found := false
+	for _, glob := range include {
+		if strings.HasPrefix(glob, "!") {
+			continue
+		}
+		if matchGlob(glob, name) {
+			return true
+		}
+		found = true
+	}
+	return !found
+}
+
+// excludeGlobs returns true if any glob in exclude or negated (!) glob in include matches name.
+func excludeGlobs(include, exclude []string, name string) bool {
+	for _, glob := range include {
+		if strings.HasPrefix(glob, "!") && matchGlob(glob[1:], name) {
+			return true
+		}
+	}
+	for _, glob := range exclude {
+		if matchGlob(glob, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob returns true if glob matches name, which must be separated by /.
+// Globs containing / are matched against the full name, and others against the base name.
+// The ** element matches zero or more path elements.
+func matchGlob(glob, name string) bool {
+	name = strings.TrimPrefix(strings.TrimSuffix(name, "/"), "./")
+	if !strings.Contains(glob, "/") {
+		ok, _ := path.Match(glob, path.Base(name))
+		return ok
+	}
+	return matchElems(strings.Split(glob, "/"), strings.Split(name, "/"))
+}
+
+func matchElems(glob, name []string) bool {
+	for ; len(glob) > 0; glob, name = glob[1:], name[1:] {
+		if glob[0] == "**" {
+			for i := range name {
+				if matchElems(glob[1:], name[i:]) {
+					return true
+				}
+			}
+			return matchElems(glob[1:], nil)
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(glob[0], name[0]); !ok {
+			return false
+		}
+	}
+	return len(name) == 0
+}
+
+func (zt *ZTgrep) findPath(ctx context.Context, out chan<- Result, path string) {
+	if zt.MaxCount > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		in := make(chan Result)
+		done := make(chan struct{})
+		go func(out chan<- Result) {
+			limitResults(out, in, zt.MaxCount, zt.After, cancel)
+			close(done)
+		}(out)
+		defer func() {
+			close(in)
+			<-done
+		}()
+		out = in
+	}
 	if path == "-" {
-		zt.find(out, os.Stdin, []string{"-"})
+		zt.find(ctx, out, ctxReader{ctx, os.Stdin}, []string{"-"}, nil, zt.skipBody([]string{"-"}, true))
 		return
 	}
 	f, err := os.Open(path)
@@ -92,75 +416,506 @@ func (zt *ZTgrep) findPath(out chan<- Result, path string) {
 		return
 	}
 	defer f.Close()
-	zt.find(out, f, []string{path})
+
+	// closing f aborts all readers, including nested decompressors
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			f.Close()
+		case <-done:
+		}
+	}()
+
+	fi, _ := f.Stat()
+	if (zt.PathMatch || zt.AllNames) && !zt.SkipName && !zt.RequireName && zt.matchName([]string{path}) {
+		out <- Result{Path: []string{path}, Info: fi}
+	}
+	if zt.Images && fi != nil && fi.IsDir() {
+		zt.find(ctx, out, archiveReader{strings.NewReader(""), zt.imageDirReader(path)}, []string{path}, fi, zt.SkipBody)
+		return
+	}
+	zt.find(ctx, out, f, []string{path}, fi, zt.skipBody([]string{path}, true))
+}
+
+// skipBody returns true if the contents of the file at path should not be searched.
+func (zt *ZTgrep) skipBody(path []string, include bool) bool {
+	return zt.SkipBody || zt.bodyExp == nil || !include || zt.RequireName && !zt.matchName(path)
+}
+
+// limitResults sends results from in to out until max matches are sent, followed by up to after lines of
+// trailing context for the last match, then calls cancel and discards remaining results.
+// Results from in must be ordered, as they are for a single path.
+func limitResults(out chan<- Result, in <-chan Result, max, after int, cancel func()) {
+	var (
+		n    int
+		last Result
+	)
+	for res := range in {
+		if n >= max {
+			if after > 0 && res.LineNum > 0 && res.LineNum == last.LineNum+1 && samePath(res.Path, last.Path) {
+				// like grep, matches within trailing context are reported as context
+				res.Context = true
+				out <- res
+				last = res
+				after--
+			} else {
+				after = 0
+			}
+			if after == 0 {
+				cancel()
+			}
+			continue
+		}
+		out <- res
+		if res.Err == nil && !res.Context {
+			if n++; n >= max {
+				last = res
+				if res.LineNum == 0 {
+					after = 0
+				}
+				if after == 0 {
+					cancel()
+				}
+			}
+		}
+	}
 }
 
-// TODO: implement version that uses file headers to identify type
-func (zt *ZTgrep) find(out chan<- Result, zr io.Reader, path []string) {
-	zf, xf := zt.newDecompressor(path[len(path)-1])
-	if xf == nil && zt.SkipBody {
+func samePath(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (zt *ZTgrep) find(ctx context.Context, out chan<- Result, zr io.Reader, path []string, info fs.FileInfo, skipBody bool) {
+	var (
+		hdr []byte
+		zf  decompressor
+		xf  extractor
+
+		// with DetectBoth, files identified by headers that cannot be read are searched as plain files
+		zfMagic, xfMagic bool
+	)
+	if ar, ok := zr.(archiveReader); ok {
+		zr, hdr = peekHeader(ar.Reader)
+		zf, _ = zt.magicDecompressor(hdr)
+		xf = ar.xf
+	} else {
+		if zt.Detect != DetectExt {
+			zr, hdr = peekHeader(zr)
+		}
+		zf, xf = zt.newDecompressor(path[len(path)-1], hdr)
+		if zt.Detect == DetectBoth {
+			mzf, mxf := zt.magicDecompressor(hdr)
+			zfMagic, xfMagic = mzf != nil, mxf != nil
+		}
+	}
+	if zf == nil && xf == nil && skipBody {
+		return
+	}
+	r := zr
+	if zf != nil {
+		var rp *replay
+		if zfMagic {
+			zr, rp = newReplay(zr)
+		}
+		rc, err := zf(ctx, zr)
+		if err == nil {
+			r, err = rp.check(rc)
+		}
+		if err != nil {
+			if rc != nil {
+				rc.Close()
+			}
+			if pr, ok := rp.reader(ctx, err); ok {
+				zt.findBody(ctx, out, pr, path, info, skipBody)
+				return
+			}
+			out <- Result{Path: path, Err: err}
+			return
+		}
+		defer rc.Close()
+		if xf == nil && zt.Detect != DetectExt {
+			r, hdr = peekHeader(r)
+			_, xf = zt.magicDecompressor(hdr)
+			xfMagic = xf != nil && zt.Detect == DetectBoth
+		}
+	}
+
+	if xf == nil {
+		zt.findBody(ctx, out, r, path, info, skipBody)
 		return
 	}
-	r, err := zf(zr)
+
+	var rp *replay
+	if xfMagic {
+		r, rp = newReplay(r)
+	}
+	found := false
+	fn := zt.findEntry(ctx, out, path)
+	err := xf(r, func(name string, fi fs.FileInfo, fr io.Reader) error {
+		if !found {
+			found = true
+			rp.stop()
+		}
+		return fn(name, fi, fr)
+	})
+	if err != nil && !found {
+		if pr, ok := rp.reader(ctx, err); ok {
+			zt.findBody(ctx, out, pr, path, info, skipBody)
+			return
+		}
+	}
 	if err != nil {
 		out <- Result{Path: path, Err: err}
 		return
 	}
-	defer r.Close()
+}
 
-	if xf == nil {
-		if zt.exp.MatchReader(bufio.NewReader(r)) {
-			out <- Result{Path: path}
-		}
+// findBody searches the contents of a file that is not an archive.
+func (zt *ZTgrep) findBody(ctx context.Context, out chan<- Result, r io.Reader, path []string, info fs.FileInfo, skipBody bool) {
+	if skipBody {
 		return
 	}
+	if zt.Lines || zt.Before > 0 || zt.After > 0 {
+		zt.findLines(ctx, out, r, path, info)
+	} else if zt.bodyExp.MatchReader(bufio.NewReader(r)) {
+		out <- Result{Path: path, Info: info, Body: true}
+	}
+}
 
-	if err := xf(r, func(name string, fr io.Reader) error {
+// replay records the start of a stream, so that it may be searched again as a plain file
+// if it cannot be read in the format identified by its header.
+// Methods on a nil *replay are no-ops.
+type replay struct {
+	f   *os.File // replayed by seeking, if not nil
+	src io.Reader
+	buf limitedBuffer
+}
+
+// newReplay returns a reader for r that is recorded by the returned *replay.
+func newReplay(r io.Reader) (io.Reader, *replay) {
+	if f, ok := r.(*os.File); ok && f != os.Stdin {
+		return f, &replay{f: f}
+	}
+	rp := &replay{src: r, buf: limitedBuffer{max: maxReplaySize}}
+	return io.TeeReader(r, &rp.buf), rp
+}
+
+// check returns r after verifying that it can be read, and stops recording.
+func (rp *replay) check(r io.Reader) (io.Reader, error) {
+	if rp == nil {
+		return r, nil
+	}
+	br := bufio.NewReader(r)
+	if _, err := br.Peek(1); err != nil && err != io.EOF {
+		return nil, err
+	}
+	rp.stop()
+	return br, nil
+}
+
+// stop ends recording after the stream is successfully read.
+func (rp *replay) stop() {
+	if rp != nil {
+		rp.buf.buf, rp.buf.overflow = nil, true
+	}
+}
+
+// reader returns a reader for the entire stream, if it can be replayed after err.
+// Errors caused by cancellation or size limits do not indicate a misidentified format.
+func (rp *replay) reader(ctx context.Context, err error) (io.Reader, bool) {
+	var tle tooLargeError
+	switch {
+	case rp == nil, ctx.Err() != nil, errors.Is(err, errTempSize), errors.As(err, &tle):
+		return nil, false
+	case rp.f != nil:
+		_, err := rp.f.Seek(0, io.SeekStart)
+		return rp.f, err == nil
+	case rp.buf.overflow:
+		return nil, false
+	default:
+		return io.MultiReader(bytes.NewReader(rp.buf.buf), rp.src), true
+	}
+}
+
+// findEntry returns a function that searches each entry of the archive at path.
+func (zt *ZTgrep) findEntry(ctx context.Context, out chan<- Result, path []string) func(string, fs.FileInfo, io.Reader) error {
+	return func(name string, fi fs.FileInfo, fr io.Reader) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		p := append(path[:len(path):len(path)], name)
-		if !zt.SkipName {
-			if zt.exp.MatchString(name) {
-				out <- Result{Path: p}
+		if excludeGlobs(zt.EntryInclude, zt.EntryExclude, name) {
+			return nil
+		}
+		include := includeGlobs(zt.EntryInclude, name)
+		if _, ok := fr.(archiveReader); !ok && !zt.SkipName && !zt.RequireName && include {
+			if zt.matchName(p) {
+				out <- Result{Path: p, Info: fi}
 			}
 		}
-		zt.find(out, fr, p)
+		zt.find(ctx, out, fr, p, fi, zt.skipBody(p, include))
 		return nil
-	}); err != nil {
-		out <- Result{Path: path, Err: err}
-		return
 	}
 }
 
-type decompressor func(io.Reader) (io.ReadCloser, error)
+// matchName matches the last name in path, or the full path if zt.PathMatch is set.
+// If zt.AllNames is set, the names of compressed files are also matched without their compression extensions.
+func (zt *ZTgrep) matchName(path []string) bool {
+	if zt.matchPath(path) {
+		return true
+	}
+	if !zt.AllNames {
+		return false
+	}
+	name := path[len(path)-1]
+	if trimmed := trimCompressionExt(name); trimmed != name {
+		return zt.matchPath(append(path[:len(path)-1:len(path)-1], trimmed))
+	}
+	return false
+}
+
+func (zt *ZTgrep) matchPath(path []string) bool {
+	if zt.nameExp == nil {
+		return false
+	}
+	if zt.PathMatch {
+		return zt.nameExp.MatchString(strings.Join(path, zt.PathSeparator))
+	}
+	return zt.nameExp.MatchString(path[len(path)-1])
+}
 
-type extractor func(io.Reader, func(string, io.Reader) error) error
+// trimCompressionExt returns name without its compression extension, if any.
+func trimCompressionExt(name string) string {
+	p := strings.ToLower(name)
+	for _, ext := range []string{".gz", ".bz2", ".bz", ".xz", ".zst", ".zstd", ".lz4", ".lz", ".lzma", ".br", ".z"} {
+		if strings.HasSuffix(p, ext) && len(p) > len(ext) {
+			return name[:len(name)-len(ext)]
+		}
+	}
+	return name
+}
 
-func (zt *ZTgrep) newDecompressor(path string) (zf decompressor, xf extractor) {
+// archiveReader is an archive with a known format that is not identified by its name or header,
+// such as an image layer. Only its compression format is detected.
+type archiveReader struct {
+	io.Reader
+	xf extractor
+}
+
+func (zt *ZTgrep) findLines(ctx context.Context, out chan<- Result, r io.Reader, path []string, info fs.FileInfo) {
+	br := bufio.NewReader(r)
+	var (
+		offset int64
+		before []Result
+		after  int
+	)
+	for num := 1; ctx.Err() == nil; num++ {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			text := bytes.TrimSuffix(line, []byte{'\n'})
+			res := Result{Path: path, Info: info, Body: true, Line: string(text), LineNum: num, Offset: offset}
+			switch {
+			case zt.bodyExp.Match(text):
+				for _, b := range before {
+					out <- b
+				}
+				before = before[:0]
+				out <- res
+				after = zt.After
+			case after > 0:
+				res.Context = true
+				out <- res
+				after--
+			case zt.Before > 0:
+				res.Context = true
+				if len(before) == zt.Before {
+					before = append(before[:0], before[1:]...)
+				}
+				before = append(before, res)
+			}
+			offset += int64(len(line))
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			out <- Result{Path: path, Err: err}
+			return
+		}
+	}
+}
+
+// peekHeader returns the leading bytes of r without consuming them.
+func peekHeader(r io.Reader) (io.Reader, []byte) {
+	if f, ok := r.(*os.File); ok && f != os.Stdin {
+		hdr := make([]byte, headerSize)
+		if n, err := f.ReadAt(hdr, 0); err == nil || err == io.EOF {
+			return f, hdr[:n]
+		}
+	}
+	br := bufio.NewReader(r)
+	hdr, _ := br.Peek(headerSize)
+	return br, hdr
+}
+
+// A nil decompressor indicates an uncompressed stream.
+// A nil extractor indicates a stream that is not an archive.
+type decompressor func(context.Context, io.Reader) (io.ReadCloser, error)
+
+type extractor func(io.Reader, func(string, fs.FileInfo, io.Reader) error) error
+
+func (zt *ZTgrep) newDecompressor(path string, hdr []byte) (zf decompressor, xf extractor) {
+	switch zt.Detect {
+	case DetectExt:
+		return zt.extDecompressor(path)
+	case DetectMagic:
+		return zt.magicDecompressor(hdr)
+	}
+	zf, xf = zt.magicDecompressor(hdr)
+	if zf == nil && xf == nil {
+		return zt.extDecompressor(path)
+	}
+	if xf == nil {
+		_, xf = zt.extDecompressor(path)
+	}
+	return zf, xf
+}
+
+func (zt *ZTgrep) magicDecompressor(hdr []byte) (zf decompressor, xf extractor) {
+	switch {
+	case hasPrefixAt(hdr, 0, "\x1f\x8b"):
+		return gzReader, nil
+	case hasPrefixAt(hdr, 0, "BZh") && len(hdr) > 3 && hdr[3] >= '1' && hdr[3] <= '9':
+		return bz2Reader, nil
+	case hasPrefixAt(hdr, 0, "\xfd7zXZ\x00"):
+		return zt.xzReader, nil
+	case hasPrefixAt(hdr, 0, "\x28\xb5\x2f\xfd"):
+		return zt.zstReader, nil
+	case hasPrefixAt(hdr, 0, "\x04\x22\x4d\x18"), hasPrefixAt(hdr, 0, "\x02\x21\x4c\x18"):
+		return lz4Reader, nil
+	case hasPrefixAt(hdr, 0, lzipMagic):
+		return lzipReader, nil
+	case isLZMAHeader(hdr):
+		return lzmaReader, nil
+	case hasPrefixAt(hdr, 0, lzwMagic):
+		return lzwReader, nil
+	case hasPrefixAt(hdr, 0, "PK\x03\x04"), hasPrefixAt(hdr, 0, "PK\x05\x06"):
+		return nil, zt.zipReader
+	case hasPrefixAt(hdr, 0, "7z\xbc\xaf\x27\x1c"):
+		return nil, zt.sevenZipReader
+	case hasPrefixAt(hdr, 0, "Rar!\x1a\x07"):
+		return nil, rarReader
+	case hasPrefixAt(hdr, 0, arMagic):
+		return nil, arReader
+	case hasPrefixAt(hdr, 0, rpmMagic):
+		return zt.rpmReader, zt.cpioReader
+	case hasPrefixAt(hdr, 0, cpioNewcMagic), hasPrefixAt(hdr, 0, cpioCRCMagic), hasPrefixAt(hdr, 0, cpioODCMagic):
+		return nil, zt.cpioReader
+	case hasPrefixAt(hdr, 257, "ustar"):
+		return nil, zt.tarReader
+	default:
+		return nil, nil
+	}
+}
+
+func (zt *ZTgrep) extDecompressor(path string) (zf decompressor, xf extractor) {
 	p := strings.ToLower(path)
 	switch {
 	case hasSuffixes(p, ".tar.gz", ".tgz", ".taz"):
-		return gzReader, tarReader
+		return gzReader, zt.tarReader
 	case hasSuffixes(p, ".tar.bz2", ".tar.bz", ".tbz", ".tbz2", ".tz2", ".tb2"):
-		return bz2Reader, tarReader
+		return bz2Reader, zt.tarReader
 	case hasSuffixes(p, ".tar.xz", ".txz"):
-		return xzReader, tarReader
+		return zt.xzReader, zt.tarReader
 	case hasSuffixes(p, ".tar.zst", ".tzst", ".tar.zstd"):
-		return zstReader, tarReader
+		return zt.zstReader, zt.tarReader
+	case hasSuffixes(p, ".tar.lz4", ".tlz4"):
+		return lz4Reader, zt.tarReader
+	case hasSuffixes(p, ".tar.lz", ".tlz"):
+		return lzipReader, zt.tarReader
+	case hasSuffixes(p, ".tar.lzma", ".tlzma"):
+		return lzmaReader, zt.tarReader
+	case hasSuffixes(p, ".tar.br", ".tbr"):
+		return brReader, zt.tarReader
+	case hasSuffixes(p, ".tar.z", ".tz"):
+		return lzwReader, zt.tarReader
 	case hasSuffixes(p, ".tar"):
-		return nopReader, tarReader
+		return nil, zt.tarReader
+	case hasSuffixes(p, ".cpio.gz"):
+		return gzReader, zt.cpioReader
+	case hasSuffixes(p, ".cpio.bz2"):
+		return bz2Reader, zt.cpioReader
+	case hasSuffixes(p, ".cpio.xz"):
+		return zt.xzReader, zt.cpioReader
+	case hasSuffixes(p, ".cpio.zst", ".cpio.zstd"):
+		return zt.zstReader, zt.cpioReader
+	case hasSuffixes(p, ".cpio"):
+		return nil, zt.cpioReader
 	case hasSuffixes(p, ".zip"):
-		return nopReader, zt.zipReader
+		return nil, zt.zipReader
+	case hasSuffixes(p, ".7z"):
+		return nil, zt.sevenZipReader
+	case hasSuffixes(p, ".rar"):
+		return nil, rarReader
+	case hasSuffixes(p, ".a", ".ar", ".deb"):
+		return nil, arReader
+	case hasSuffixes(p, ".rpm"):
+		return zt.rpmReader, zt.cpioReader
+	case hasSuffixes(p, ".iso"):
+		return nil, zt.isoReader
 
 	case hasSuffixes(p, ".gz"):
 		return gzReader, nil
 	case hasSuffixes(p, ".bz2", ".bz"):
 		return bz2Reader, nil
 	case hasSuffixes(p, ".xz"):
-		return xzReader, nil
+		return zt.xzReader, nil
 	case hasSuffixes(p, ".zst", ".zstd"):
-		return zstReader, nil
+		return zt.zstReader, nil
+	case hasSuffixes(p, ".lz4"):
+		return lz4Reader, nil
+	case hasSuffixes(p, ".lz"):
+		return lzipReader, nil
+	case hasSuffixes(p, ".lzma"):
+		return lzmaReader, nil
+	case hasSuffixes(p, ".br"):
+		return brReader, nil
+	case hasSuffixes(p, ".z"):
+		return lzwReader, nil
 	default:
-		return nopReader, nil
+		return nil, nil
+	}
+}
+
+// isLZMAHeader returns true if hdr starts with a .lzma header with the default properties,
+// a dictionary size of 2^n or 2^n+2^(n-1) bytes, and a known or reasonable uncompressed size.
+func isLZMAHeader(hdr []byte) bool {
+	if len(hdr) < 13 || hdr[0] != 0x5d {
+		return false
+	}
+	dict := binary.LittleEndian.Uint32(hdr[1:5])
+	if dict < 1<<12 {
+		return false
+	}
+	for dict&1 == 0 {
+		dict >>= 1
 	}
+	size := binary.LittleEndian.Uint64(hdr[5:13])
+	return (dict == 1 || dict == 3) && (size == ^uint64(0) || size < 1<<38)
+}
+
+func hasPrefixAt(b []byte, offset int, prefix string) bool {
+	return len(b) >= offset && strings.HasPrefix(string(b[offset:]), prefix)
 }
 
 func hasSuffixes(s string, suffixes ...string) bool {
@@ -172,55 +927,131 @@ func hasSuffixes(s string, suffixes ...string) bool {
 	return false
 }
 
-func tarReader(r io.Reader, fn func(string, io.Reader) error) error {
+// tarReader searches tar files as container images if zt.Images is set.
+func (zt *ZTgrep) tarReader(r io.Reader, fn func(string, fs.FileInfo, io.Reader) error) error {
+	if zt.Images {
+		return zt.imageTarReader(r, fn)
+	}
+	return tarReader(r, fn)
+}
+
+func tarReader(r io.Reader, fn func(string, fs.FileInfo, io.Reader) error) error {
 	tr := tar.NewReader(r)
 	for h, err := tr.Next(); err != io.EOF; h, err = tr.Next() {
 		if err != nil {
 			return err
 		}
-		if err := fn(h.Name, tr); err != nil {
+		if err := fn(h.Name, h.FileInfo(), tr); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (zt *ZTgrep) zipReader(r io.Reader, fn func(string, io.Reader) error) error {
-	tr, err := zt.readZip(r)
+func (zt *ZTgrep) zipReader(r io.Reader, fn func(string, fs.FileInfo, io.Reader) error) error {
+	skip := 0
+	if _, ok := r.(*os.File); zt.StreamZip && (!ok || r == os.Stdin) {
+		// stream the zip file, falling back to the central directory if the stream cannot be parsed
+		buf := &limitedBuffer{max: zt.MaxZipSize}
+		if zt.Spill {
+			// streamed zip files are recorded in case streaming fails, but only count towards
+			// zt.MaxTempSize if the recording is needed
+			buf.spill = func() (*tempFile, error) {
+				tf, err := zt.newTempFile()
+				if err == nil {
+					tf.uncharged = true
+				}
+				return tf, err
+			}
+		}
+		defer buf.Close()
+		var fnErr error
+		n, err := streamZip(io.TeeReader(r, buf), func(name string, fi fs.FileInfo, fr io.Reader) error {
+			fnErr = fn(name, fi, fr)
+			return fnErr
+		})
+		if err == nil || fnErr != nil {
+			return err
+		}
+		if buf.tf != nil {
+			if _, err := io.Copy(buf, r); err != nil {
+				return err
+			}
+		}
+		switch {
+		case buf.err != nil:
+			return buf.err
+		case buf.tf != nil:
+			if err := buf.tf.charge(); err != nil {
+				return err
+			}
+			r = buf.tf.f
+		case buf.overflow:
+			return err
+		default:
+			r = io.MultiReader(bytes.NewReader(buf.buf), r)
+		}
+		skip = n
+	}
+	tr, closer, err := zt.readZip(r)
 	if err != nil {
 		return err
 	}
-	for _, file := range tr.File {
+	defer closer.Close()
+	for i, file := range tr.File {
+		if i < skip {
+			continue // already searched by streaming
+		}
 		fr, err := file.Open()
 		if err != nil {
 			return err // TODO: process next file if alg error?
 		}
-		if err := fn(file.Name, fr); err != nil {
+		if err := fn(file.Name, file.FileInfo(), fr); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func nopReader(r io.Reader) (io.ReadCloser, error) {
-	return io.NopCloser(r), nil
-}
-
-func gzReader(r io.Reader) (io.ReadCloser, error) {
+func gzReader(_ context.Context, r io.Reader) (io.ReadCloser, error) {
 	r, err := gzip.NewReader(r)
 	return io.NopCloser(r), err
 }
 
-func bz2Reader(r io.Reader) (io.ReadCloser, error) {
+func bz2Reader(_ context.Context, r io.Reader) (io.ReadCloser, error) {
 	return io.NopCloser(bzip2.NewReader(r)), nil
 }
 
-func xzReader(r io.Reader) (io.ReadCloser, error) {
-	return zCmdReader(exec.Command("xz", "-d", "-T0"), r)
+func (zt *ZTgrep) xzReader(ctx context.Context, r io.Reader) (io.ReadCloser, error) {
+	if zt.Exec {
+		return zCmdReader(exec.CommandContext(ctx, "xz", "-d", "-T0"), r)
+	}
+	r, err := xz.NewReader(r)
+	return io.NopCloser(r), err
 }
 
-func zstReader(r io.Reader) (io.ReadCloser, error) {
-	return zCmdReader(exec.Command("zstd", "-d"), r)
+func (zt *ZTgrep) zstReader(ctx context.Context, r io.Reader) (io.ReadCloser, error) {
+	if zt.Exec {
+		return zCmdReader(exec.CommandContext(ctx, "zstd", "-d"), r)
+	}
+	d, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return d.IOReadCloser(), nil
+}
+
+func lz4Reader(_ context.Context, r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(lz4.NewReader(r)), nil
+}
+
+func lzmaReader(_ context.Context, r io.Reader) (io.ReadCloser, error) {
+	r, err := lzma.NewReader(r)
+	return io.NopCloser(r), err
+}
+
+func brReader(_ context.Context, r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(brotli.NewReader(r)), nil
 }
 
 func zCmdReader(cmd *exec.Cmd, r io.Reader) (io.ReadCloser, error) {
@@ -233,37 +1064,157 @@ func zCmdReader(cmd *exec.Cmd, r io.Reader) (io.ReadCloser, error) {
 		return nil, err
 	}
 	return splitCloser{out, closerFunc(func() error {
+		out.Close() // stop command if output is not fully read
 		return cmd.Wait()
 	})}, nil
 }
 
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
 type closerFunc func() error
 
 func (f closerFunc) Close() error {
 	return f()
 }
 
+var nopCloser = closerFunc(func() error { return nil })
+
 type splitCloser struct {
 	io.Reader
 	io.Closer
 }
 
-func (zt *ZTgrep) readZip(r io.Reader) (*zip.Reader, error) {
+func (zt *ZTgrep) readZip(r io.Reader) (*zip.Reader, io.Closer, error) {
+	ra, n, closer, err := zt.readerAt(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	zr, err := zip.NewReader(ra, n)
+	if err != nil {
+		closer.Close()
+		return nil, nil, err
+	}
+	return zr, closer, nil
+}
+
+// readerAt returns r as an io.ReaderAt, reading it into memory or a temporary file if necessary.
+// The returned io.Closer must be closed when the io.ReaderAt is no longer needed.
+func (zt *ZTgrep) readerAt(r io.Reader) (io.ReaderAt, int64, io.Closer, error) {
 	if f, ok := r.(*os.File); ok && f != os.Stdin {
 		if fi, err := f.Stat(); err == nil {
 			if n := fi.Size(); n > 0 {
-				return zip.NewReader(f, n)
+				return f, n, nopCloser, nil
 			}
 		}
 	}
 	limitedReader := &io.LimitedReader{R: r, N: zt.MaxZipSize}
 	data, err := ioutil.ReadAll(limitedReader)
 	if err != nil {
-		return nil, err
+		return nil, 0, nil, err
 	}
 	if limitedReader.N <= 0 {
-		return nil, errors.New("nested zip file larger than limit")
+		if !zt.Spill {
+			return nil, 0, nil, tooLargeError{io.MultiReader(bytes.NewReader(data), r)}
+		}
+		return zt.spill(io.MultiReader(bytes.NewReader(data), r))
 	}
 	br := bytes.NewReader(data)
-	return zip.NewReader(br, br.Size())
+	return br, br.Size(), nopCloser, nil
+}
+
+var errTempSize = errors.New("temporary files larger than limit")
+
+// tooLargeError is returned by readerAt when a stream is larger than zt.MaxZipSize and zt.Spill is not set.
+// Reader replays the stream from the beginning.
+type tooLargeError struct {
+	io.Reader
+}
+
+func (tooLargeError) Error() string {
+	return "nested archive larger than limit"
+}
+
+// spill reads r into a temporary file, which is removed when the returned io.Closer is closed.
+func (zt *ZTgrep) spill(r io.Reader) (io.ReaderAt, int64, io.Closer, error) {
+	tf, err := zt.newTempFile()
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	n, err := io.Copy(tf, r)
+	if err != nil {
+		tf.Close()
+		return nil, 0, nil, err
+	}
+	return tf.f, n, tf, nil
+}
+
+func (zt *ZTgrep) newTempFile() (*tempFile, error) {
+	f, err := os.CreateTemp(zt.TempDir, "ztgrep-*")
+	if err != nil {
+		return nil, err
+	}
+	return &tempFile{f: f, zt: zt}, nil
+}
+
+// tempFile is a temporary file that counts towards zt.MaxTempSize until closed.
+// An uncharged tempFile is only limited to zt.MaxTempSize by itself until charge is called.
+type tempFile struct {
+	f         *os.File
+	zt        *ZTgrep
+	size      int64
+	uncharged bool
+}
+
+func (t *tempFile) Write(p []byte) (int, error) {
+	if t.uncharged {
+		if max := t.zt.MaxTempSize; max > 0 && t.size+int64(len(p)) > max {
+			return 0, errTempSize
+		}
+		n, err := t.f.Write(p)
+		t.size += int64(n)
+		return n, err
+	}
+	total := atomic.AddInt64(&t.zt.tempSize, int64(len(p)))
+	if max := t.zt.MaxTempSize; max > 0 && total > max {
+		atomic.AddInt64(&t.zt.tempSize, -int64(len(p)))
+		return 0, errTempSize
+	}
+	n, err := t.f.Write(p)
+	t.size += int64(n)
+	if n < len(p) {
+		atomic.AddInt64(&t.zt.tempSize, -int64(len(p)-n))
+	}
+	return n, err
+}
+
+// charge counts an uncharged tempFile towards zt.MaxTempSize.
+func (t *tempFile) charge() error {
+	if !t.uncharged {
+		return nil
+	}
+	total := atomic.AddInt64(&t.zt.tempSize, t.size)
+	if max := t.zt.MaxTempSize; max > 0 && total > max {
+		atomic.AddInt64(&t.zt.tempSize, -t.size)
+		return errTempSize
+	}
+	t.uncharged = false
+	return nil
+}
+
+func (t *tempFile) Close() error {
+	if !t.uncharged {
+		defer atomic.AddInt64(&t.zt.tempSize, -t.size)
+	}
+	t.f.Close()
+	return os.Remove(t.f.Name())
 }
@@ -1,8 +1,21 @@
 package ztgrep_test
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/sclevine/ztgrep"
 )
@@ -174,4 +187,1334 @@ func TestZTgrepZip(t *testing.T) {
 	if i != len(tt) {
 		t.Error("Too few results")
 	}
-}
\ No newline at end of file
+}
+
+func TestZTgrepMagic(t *testing.T) {
+	zt, err := ztgrep.New("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zt.Detect = ztgrep.DetectMagic
+	tt := []string{
+		"testdata/test-l2.bin:test-l1.zip",
+		"testdata/test-l2.bin:test-l1.zip:test.tgz",
+		"testdata/test-l2.bin:test-l1.zip:test.tgz:testfile1",
+		"testdata/test-l2.bin:test-l1.zip:test.tgz:testfile1",
+		"testdata/test-l2.bin:test-l1.zip:test.tgz:testfile2",
+		"testdata/test-l2.bin:test-l1.zip:test.tgz:testfile2",
+		"testdata/test-l2.bin:test-l1.zip:test.zip",
+		"testdata/test-l2.bin:test-l1.zip:test.zip:testfile1",
+		"testdata/test-l2.bin:test-l1.zip:test.zip:testfile1",
+		"testdata/test-l2.bin:test-l1.zip:test.zip:testfile2",
+		"testdata/test-l2.bin:test-l1.zip:test.zip:testfile2",
+		"testdata/test-l2.bin:test-l1.zip:testfile1",
+		"testdata/test-l2.bin:test-l1.zip:testfile1",
+		"testdata/test-l2.bin:test-l1.zip:testfile2",
+		"testdata/test-l2.bin:test-l1.zip:testfile2",
+		"testdata/test-l2.bin:test.tgz",
+		"testdata/test-l2.bin:test.tgz:testfile1",
+		"testdata/test-l2.bin:test.tgz:testfile1",
+		"testdata/test-l2.bin:test.tgz:testfile2",
+		"testdata/test-l2.bin:test.tgz:testfile2",
+	}
+	i := 0
+	for res := range zt.Start([]string{"testdata/test-l2.bin"}) {
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		if p := strings.Join(res.Path, ":"); p != tt[i] {
+			t.Errorf("%s != %s", p, tt[i])
+		}
+		i++
+	}
+	if i != len(tt) {
+		t.Error("Too few results")
+	}
+}
+
+func TestZTgrepMisidentified(t *testing.T) {
+	zt, err := ztgrep.New("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zt.Ordered = true
+	files := []string{
+		"bzip2.txt", "BZh9 secret\n",
+		"bzip2-magic.txt", "BZh secret\n",
+		"cpio.txt", "070707 secret\n",
+		"ar.txt", "!<arch>\nsecret\n",
+		"lzma.bin", "]\x00\x00\x00\x00 secret\n",
+	}
+	dir := t.TempDir()
+	var paths, tt []string
+	for i := 0; i < len(files); i += 2 {
+		path := filepath.Join(dir, files[i])
+		if err := os.WriteFile(path, []byte(files[i+1]), 0666); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+		tt = append(tt, path)
+	}
+	path := writeTarGz(t, "test.tar.gz", files...)
+	paths = append(paths, path)
+	for i := 0; i < len(files); i += 2 {
+		tt = append(tt, path+":"+files[i])
+	}
+	i := 0
+	for res := range zt.Start(paths) {
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		if p := strings.Join(res.Path, ":"); p != tt[i] || !res.Body {
+			t.Errorf("%s != %s (body: %t)", p, tt[i], res.Body)
+		}
+		i++
+	}
+	if i != len(tt) {
+		t.Error("Too few results")
+	}
+}
+
+func TestZTgrepLines(t *testing.T) {
+	zt, err := ztgrep.New("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zt.Lines = true
+	tt := []string{
+		"testdata/test-l2.zip:test-l1.zip",
+		"testdata/test-l2.zip:test-l1.zip:test.tgz",
+		"testdata/test-l2.zip:test-l1.zip:test.tgz:testfile1",
+		"testdata/test-l2.zip:test-l1.zip:test.tgz:testfile1:1:0:test",
+		"testdata/test-l2.zip:test-l1.zip:test.tgz:testfile2",
+		"testdata/test-l2.zip:test-l1.zip:test.tgz:testfile2:1:0:test",
+		"testdata/test-l2.zip:test-l1.zip:test.zip",
+		"testdata/test-l2.zip:test-l1.zip:test.zip:testfile1",
+		"testdata/test-l2.zip:test-l1.zip:test.zip:testfile1:1:0:test",
+		"testdata/test-l2.zip:test-l1.zip:test.zip:testfile2",
+		"testdata/test-l2.zip:test-l1.zip:test.zip:testfile2:1:0:test",
+		"testdata/test-l2.zip:test-l1.zip:testfile1",
+		"testdata/test-l2.zip:test-l1.zip:testfile1:1:0:test",
+		"testdata/test-l2.zip:test-l1.zip:testfile2",
+		"testdata/test-l2.zip:test-l1.zip:testfile2:1:0:test",
+		"testdata/test-l2.zip:test.tgz",
+		"testdata/test-l2.zip:test.tgz:testfile1",
+		"testdata/test-l2.zip:test.tgz:testfile1:1:0:test",
+		"testdata/test-l2.zip:test.tgz:testfile2",
+		"testdata/test-l2.zip:test.tgz:testfile2:1:0:test",
+	}
+	i := 0
+	for res := range zt.Start([]string{"testdata/test-l2.zip"}) {
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		if res.Body != (res.LineNum > 0) {
+			t.Errorf("unexpected body result: %v", res)
+		}
+		if res.Info == nil || res.Info.Size() == 0 {
+			t.Errorf("missing info: %v", res)
+		}
+		p := strings.Join(res.Path, ":")
+		if res.LineNum > 0 {
+			p = fmt.Sprintf("%s:%d:%d:%s", p, res.LineNum, res.Offset, res.Line)
+		}
+		if p != tt[i] {
+			t.Errorf("%s != %s", p, tt[i])
+		}
+		i++
+	}
+	if i != len(tt) {
+		t.Error("Too few results")
+	}
+}
+
+func TestZTgrepContext(t *testing.T) {
+	zt, err := ztgrep.New("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zt.Before = 1
+	zt.After = 2
+	path := writeTarGz(t, "test.tar.gz",
+		"log", "1\nsecret\n3\n4\n5\n6\nsecret\nsecret\n9\n",
+	)
+	tt := []string{
+		"log-1-1",
+		"log:2:secret",
+		"log-3-3",
+		"log-4-4",
+		"log-6-6",
+		"log:7:secret",
+		"log:8:secret",
+		"log-9-9",
+	}
+	i := 0
+	for res := range zt.Start([]string{path}) {
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		sep := ":"
+		if res.Context {
+			sep = "-"
+		}
+		p := strings.Join(append(res.Path[1:], fmt.Sprint(res.LineNum), res.Line), sep)
+		if p != tt[i] {
+			t.Errorf("%s != %s", p, tt[i])
+		}
+		i++
+	}
+	if i != len(tt) {
+		t.Error("Too few results")
+	}
+}
+
+func writeTarGz(t *testing.T, name string, files ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+	for i := 0; i < len(files); i += 2 {
+		if err := tw.WriteHeader(&tar.Header{
+			Name: files[i],
+			Mode: 0644,
+			Size: int64(len(files[i+1])),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(files[i+1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestZTgrepRecursive(t *testing.T) {
+	zt, err := ztgrep.New("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zt.Recursive = true
+	zt.Include = []string{"*.tar.gz", "*.txt"}
+	zt.Exclude = []string{"skip"}
+	dir := t.TempDir()
+	for _, d := range []string{"a/b", "skip"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{"a/secret.txt", "a/b/secret.log", "skip/secret.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, f), []byte("secret\n"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Rename(writeTarGz(t, "test.tar.gz", "file", "secret\n"), filepath.Join(dir, "a/b/test.tar.gz")); err != nil {
+		t.Fatal(err)
+	}
+	tt := []string{
+		"a/b/test.tar.gz:file",
+		"a/secret.txt",
+	}
+	var results []string
+	for res := range zt.Start([]string{dir}) {
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		p, err := filepath.Rel(dir, strings.Join(res.Path, ":"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, filepath.ToSlash(p))
+	}
+	sort.Strings(results)
+	if strings.Join(results, "\n") != strings.Join(tt, "\n") {
+		t.Errorf("%v != %v", results, tt)
+	}
+
+	// directories reachable by multiple symbolic links are searched under each path, while loops are skipped
+	zt, err = ztgrep.New("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zt.Recursive = true
+	zt.FollowLinks = true
+	dir = t.TempDir()
+	for _, d := range []string{"a", "b"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "b/z.log"), []byte("secret\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../b", filepath.Join(dir, "a/link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("..", filepath.Join(dir, "b/loop")); err != nil {
+		t.Fatal(err)
+	}
+	tt = []string{
+		"a/link/z.log",
+		"b/z.log",
+	}
+	results = nil
+	for res := range zt.Start([]string{dir}) {
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		p, err := filepath.Rel(dir, strings.Join(res.Path, ":"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, filepath.ToSlash(p))
+	}
+	sort.Strings(results)
+	if strings.Join(results, "\n") != strings.Join(tt, "\n") {
+		t.Errorf("%v != %v", results, tt)
+	}
+}
+
+func TestZTgrepEntryGlobs(t *testing.T) {
+	zt, err := ztgrep.New("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zt.EntryInclude = []string{"**/*.properties", "!**/node_modules/**"}
+	zt.EntryExclude = []string{"skip/**"}
+	inner, err := os.ReadFile(writeTarGz(t, "inner.tar.gz",
+		"c.properties", "secret\n",
+		"c.txt", "secret\n",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeTarGz(t, "test.tar.gz",
+		"a/secret.properties", "secret\n",
+		"a/node_modules/b.properties", "secret\n",
+		"skip/inner.tar.gz", string(inner),
+		"lib/inner.tar.gz", string(inner),
+		"z.txt", "secret\n",
+	)
+	tt := []string{
+		"a/secret.properties",
+		"a/secret.properties",
+		"lib/inner.tar.gz:c.properties",
+	}
+	i := 0
+	for res := range zt.Start([]string{path}) {
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		if p := strings.Join(res.Path[1:], ":"); p != tt[i] {
+			t.Errorf("%s != %s", p, tt[i])
+		}
+		i++
+	}
+	if i != len(tt) {
+		t.Error("Too few results")
+	}
+}
+
+func TestZTgrepOrdered(t *testing.T) {
+	zt, err := ztgrep.New("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := []string{"testdata/test-l2.zip", "testdata/test-l2.tar.gz", "testdata/test-l2.bin", "testdata/missing"}
+	var tt []string
+	for _, path := range paths {
+		for res := range zt.Start([]string{path}) {
+			tt = append(tt, strings.Join(res.Path, ":"))
+		}
+	}
+	zt.Ordered = true
+	i := 0
+	for res := range zt.Start(paths) {
+		if p := strings.Join(res.Path, ":"); p != tt[i] {
+			t.Errorf("%s != %s", p, tt[i])
+		}
+		i++
+	}
+	if i != len(tt) {
+		t.Error("Too few results")
+	}
+}
+
+func TestZTgrepCancel(t *testing.T) {
+	zt, err := ztgrep.New("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var paths []string
+	for i := 0; i < 100; i++ {
+		paths = append(paths, "testdata/test-l2.tar.gz")
+	}
+	results := zt.StartContext(ctx, paths)
+	<-results
+	cancel()
+	timeout := time.After(5 * time.Second)
+	for n := 0; ; n++ {
+		select {
+		case _, ok := <-results:
+			if !ok {
+				return
+			}
+			if n > 0 {
+				t.Fatal("Too many results after cancel")
+			}
+		case <-timeout:
+			t.Fatal("Timeout waiting for results to close")
+		}
+	}
+}
+
+func TestZTgrepMaxCount(t *testing.T) {
+	zt, err := ztgrep.New("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zt.MaxCount = 3
+	zt.Ordered = true
+	tt := []string{
+		"testdata/test-l2.zip:test-l1.zip",
+		"testdata/test-l2.zip:test-l1.zip:test.tgz",
+		"testdata/test-l2.zip:test-l1.zip:test.tgz:testfile1",
+		"testdata/test-l2.tar.gz:test-l1.tar",
+		"testdata/test-l2.tar.gz:test-l1.tar:test.tar.bz2",
+		"testdata/test-l2.tar.gz:test-l1.tar:test.tar.bz2:testfile1",
+	}
+	i := 0
+	for res := range zt.Start([]string{"testdata/test-l2.zip", "testdata/test-l2.tar.gz"}) {
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		if p := strings.Join(res.Path, ":"); p != tt[i] {
+			t.Errorf("%s != %s", p, tt[i])
+		}
+		i++
+	}
+	if i != len(tt) {
+		t.Error("Too few results")
+	}
+
+	// trailing context follows the last match, including matches within it
+	zt, err = ztgrep.New("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zt.MaxCount = 1
+	zt.After = 2
+	path := writeTarGz(t, "test.tar.gz",
+		"log", "secret\n2\nsecret\n4\nsecret\n",
+		"other", "secret\n",
+	)
+	tt = []string{
+		"log:1:secret",
+		"log-2-2",
+		"log-3-secret",
+	}
+	i = 0
+	for res := range zt.Start([]string{path}) {
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		sep := ":"
+		if res.Context {
+			sep = "-"
+		}
+		if p := strings.Join(append(res.Path[1:], fmt.Sprint(res.LineNum), res.Line), sep); p != tt[i] {
+			t.Errorf("%s != %s", p, tt[i])
+		}
+		i++
+	}
+	if i != len(tt) {
+		t.Error("Too few results")
+	}
+}
+
+func TestZTgrepSpill(t *testing.T) {
+	zt, err := ztgrep.New("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zt.MaxZipSize = 500
+	zt.StreamZip = false
+	zt.Spill = true
+	zt.TempDir = t.TempDir()
+	var tt []string
+	for res := range zt.Start([]string{"testdata/test-l2.zip"}) {
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		tt = append(tt, strings.Join(res.Path, ":"))
+	}
+	if len(tt) != 20 {
+		t.Errorf("Wrong number of results: %d", len(tt))
+	}
+	if files, err := os.ReadDir(zt.TempDir); err != nil || len(files) != 0 {
+		t.Errorf("Temporary files not removed: %v %v", files, err)
+	}
+
+	zt.MaxTempSize = 500
+	limited := false
+	for res := range zt.Start([]string{"testdata/test-l2.zip"}) {
+		if res.Err != nil && res.Err.Error() != "temporary files larger than limit" {
+			t.Error(res.Err)
+		}
+		if res.Err != nil {
+			limited = true
+		}
+	}
+	if !limited {
+		t.Error("Expected temporary files larger than limit")
+	}
+}
+
+func TestZTgrepStreamZip(t *testing.T) {
+	zt, err := ztgrep.New("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, fh := range []*zip.FileHeader{
+		{Name: "deflate-secret", Method: zip.Deflate},
+		{Name: "store-secret", Method: zip.Store},
+		{Name: "deflate-secret-2", Method: zip.Deflate},
+	} {
+		w, err := zw.CreateHeader(fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte("secret\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := writeTarGz(t, "test.tar.gz", "test.zip", buf.String())
+
+	all := []string{
+		"test.zip:deflate-secret",
+		"test.zip:deflate-secret",
+		"test.zip:store-secret",
+		"test.zip:store-secret",
+		"test.zip:deflate-secret-2",
+		"test.zip:deflate-secret-2",
+	}
+	failed := []string{
+		"test.zip:deflate-secret",
+		"test.zip:deflate-secret",
+		"test.zip",
+	}
+	for _, tc := range []struct {
+		maxZipSize  int64
+		spill       bool
+		maxTempSize int64
+		tt          []string
+		err         string
+	}{
+		{1 << 20, false, 0, all, ""},
+		{1, false, 0, failed, "zip file cannot be streamed"},
+		{1, true, 0, all, ""},
+		{1, true, 10, failed, "temporary files larger than limit"},
+	} {
+		zt.MaxZipSize = tc.maxZipSize
+		zt.Spill = tc.spill
+		zt.MaxTempSize = tc.maxTempSize
+		zt.TempDir = t.TempDir()
+		i := 0
+		for res := range zt.Start([]string{path}) {
+			if p := strings.Join(res.Path[1:], ":"); p != tc.tt[i] {
+				t.Errorf("%s != %s", p, tc.tt[i])
+			}
+			if i == 2 && tc.err != "" {
+				if res.Err == nil || res.Err.Error() != tc.err {
+					t.Errorf("Expected error %q, got %v", tc.err, res.Err)
+				}
+			} else if res.Err != nil {
+				t.Errorf("Unexpected error: %v", res.Err)
+			}
+			i++
+		}
+		if i != len(tc.tt) {
+			t.Error("Too few results")
+		}
+		if files, err := os.ReadDir(zt.TempDir); err != nil || len(files) != 0 {
+			t.Errorf("Temporary files not removed: %v %v", files, err)
+		}
+	}
+}
+
+func TestZTgrep7z(t *testing.T) {
+	zt, err := ztgrep.New("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile("testdata/test.7z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeTarGz(t, "test.tar.gz", "test.7z", string(data))
+	tt := []string{
+		"testdata/test.7z:testfile1",
+		"testdata/test.7z:testfile1",
+		"testdata/test.7z:testfile2",
+		"testdata/test.7z:testfile2",
+		path + ":test.7z",
+		path + ":test.7z:testfile1",
+		path + ":test.7z:testfile1",
+		path + ":test.7z:testfile2",
+		path + ":test.7z:testfile2",
+	}
+	zt.Ordered = true
+	i := 0
+	for res := range zt.Start([]string{"testdata/test.7z", path}) {
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		if p := strings.Join(res.Path, ":"); p != tt[i] {
+			t.Errorf("%s != %s", p, tt[i])
+		}
+		i++
+	}
+	if i != len(tt) {
+		t.Error("Too few results")
+	}
+}
+
+func TestZTgrepRar(t *testing.T) {
+	zt, err := ztgrep.New("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile("testdata/test.rar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeTarGz(t, "test.tar.gz", "test.rar", string(data))
+	tt := []string{
+		"testdata/test.rar:testfile1",
+		"testdata/test.rar:testfile1",
+		"testdata/test.rar:testfile2",
+		"testdata/test.rar:testfile2",
+		"testdata/test-v4.rar:testfile1",
+		"testdata/test-v4.rar:testfile1",
+		"testdata/test-v4.rar:testfile2",
+		"testdata/test-v4.rar:testfile2",
+		path + ":test.rar",
+		path + ":test.rar:testfile1",
+		path + ":test.rar:testfile1",
+		path + ":test.rar:testfile2",
+		path + ":test.rar:testfile2",
+	}
+	zt.Ordered = true
+	i := 0
+	for res := range zt.Start([]string{"testdata/test.rar", "testdata/test-v4.rar", path}) {
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		if p := strings.Join(res.Path, ":"); p != tt[i] {
+			t.Errorf("%s != %s", p, tt[i])
+		}
+		i++
+	}
+	if i != len(tt) {
+		t.Error("Too few results")
+	}
+}
+
+func writeAr(t *testing.T, name string, files ...string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	buf.WriteString("!<arch>\n")
+	header := func(name string, size int) {
+		fmt.Fprintf(&buf, "%-16s%-12d%-6d%-6d%-8o%-10d`\n", name, 1644550304, 0, 0, 0644, size)
+	}
+	pad := func() {
+		if buf.Len()%2 != 0 {
+			buf.WriteByte('\n')
+		}
+	}
+	var names bytes.Buffer
+	for i := 0; i < len(files); i += 2 {
+		if len(files[i]) > 15 && !strings.HasPrefix(files[i], "#1/") {
+			names.WriteString(files[i] + "/\n")
+		}
+	}
+	if names.Len() > 0 {
+		header("//", names.Len())
+		buf.Write(names.Bytes())
+		pad()
+	}
+	offset := 0
+	for i := 0; i < len(files); i += 2 {
+		switch n := files[i]; {
+		case strings.HasPrefix(n, "#1/"): // BSD
+			header(fmt.Sprintf("#1/%d", len(n)-3), len(n)-3+len(files[i+1]))
+			buf.WriteString(n[3:])
+		case len(n) > 15: // GNU
+			header(fmt.Sprintf("/%d", offset), len(files[i+1]))
+			offset += len(n) + 2
+		default:
+			header(n+"/", len(files[i+1]))
+		}
+		buf.WriteString(files[i+1])
+		pad()
+	}
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, buf.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestZTgrepAr(t *testing.T) {
+	zt, err := ztgrep.New("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	control, err := os.ReadFile(writeTarGz(t, "control.tar.gz", "./control", "Package: test\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(writeTarGz(t, "data.tar.gz", "./etc/secret", "secret\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deb := writeAr(t, "test.deb",
+		"debian-binary", "2.0\n",
+		"control.tar.gz", string(control),
+		"data.tar.gz", string(data),
+	)
+	lib := writeAr(t, "test.a",
+		"long-secret-name.o", "secret",
+		"#1/bsd-secret-name.o", "secret\n",
+		"short.o", "none",
+	)
+	tt := []string{
+		deb + ":data.tar.gz:./etc/secret",
+		deb + ":data.tar.gz:./etc/secret",
+		lib + ":long-secret-name.o",
+		lib + ":long-secret-name.o",
+		lib + ":bsd-secret-name.o",
+		lib + ":bsd-secret-name.o",
+	}
+	zt.Ordered = true
+	i := 0
+	for res := range zt.Start([]string{deb, lib}) {
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		if p := strings.Join(res.Path, ":"); p != tt[i] {
+			t.Errorf("%s != %s", p, tt[i])
+		}
+		i++
+	}
+	if i != len(tt) {
+		t.Error("Too few results")
+	}
+	// BSD name with an excessive length (reported as an error when formats are identified only by headers)
+	zt.Detect = ztgrep.DetectMagic
+	corrupt := fmt.Sprintf("!<arch>\n%-16s%-12d%-6d%-6d%-8o%-10d`\n", "#1/3000000000", 0, 0, 0, 0644, int64(9999999999))
+	path := filepath.Join(t.TempDir(), "corrupt.a")
+	if err := os.WriteFile(path, []byte(corrupt), 0666); err != nil {
+		t.Fatal(err)
+	}
+	i = 0
+	for res := range zt.Start([]string{path}) {
+		if res.Err == nil || res.Err.Error() != "invalid ar header" {
+			t.Errorf("Unexpected result: %v", res)
+		}
+		i++
+	}
+	if i != 1 {
+		t.Errorf("Expected 1 result, got %d", i)
+	}
+}
+
+func TestZTgrepRPM(t *testing.T) {
+	zt, err := ztgrep.New("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile("testdata/test.rpm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeTarGz(t, "test.tar.gz", "test.rpm", string(data))
+	tt := []string{
+		"testdata/test.rpm:./usr/testfile1",
+		"testdata/test.rpm:./usr/testfile1",
+		"testdata/test.rpm:./usr/testfile2",
+		"testdata/test.rpm:./usr/testfile2",
+		path + ":test.rpm",
+		path + ":test.rpm:./usr/testfile1",
+		path + ":test.rpm:./usr/testfile1",
+		path + ":test.rpm:./usr/testfile2",
+		path + ":test.rpm:./usr/testfile2",
+	}
+	zt.Ordered = true
+	i := 0
+	for res := range zt.Start([]string{"testdata/test.rpm", path}) {
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		if p := strings.Join(res.Path, ":"); p != tt[i] {
+			t.Errorf("%s != %s", p, tt[i])
+		}
+		i++
+	}
+	if i != len(tt) {
+		t.Error("Too few results")
+	}
+
+	// signature header with an excessive index count (reported as an error when formats are identified only by headers)
+	zt.Detect = ztgrep.DetectMagic
+	corrupt := append([]byte{}, data[:96+8]...)
+	corrupt = append(corrupt, 0x7f, 0xff, 0xff, 0xff, 0, 0, 0, 0)
+	path = filepath.Join(t.TempDir(), "corrupt.rpm")
+	if err := os.WriteFile(path, corrupt, 0666); err != nil {
+		t.Fatal(err)
+	}
+	i = 0
+	for res := range zt.Start([]string{path}) {
+		if res.Err == nil || !strings.Contains(res.Err.Error(), "invalid rpm header") {
+			t.Errorf("Unexpected result: %v", res)
+		}
+		i++
+	}
+	if i != 1 {
+		t.Errorf("Expected 1 result, got %d", i)
+	}
+}
+
+func TestZTgrepCPIO(t *testing.T) {
+	zt, err := ztgrep.New("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	for _, name := range []string{"testdata/test-odc.cpio", "testdata/test-newc.cpio"} {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := zw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	initrd := filepath.Join(t.TempDir(), "initrd.img")
+	if err := os.WriteFile(initrd, buf.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+	// uncompressed early cpio followed by a compressed cpio
+	early, err := os.ReadFile("testdata/test-bin.cpio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	zw = gzip.NewWriter(&buf)
+	data, err := os.ReadFile("testdata/test-newc.cpio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	microcode := filepath.Join(t.TempDir(), "microcode.cpio")
+	if err := os.WriteFile(microcode, append(early, buf.Bytes()...), 0666); err != nil {
+		t.Fatal(err)
+	}
+	var tt []string
+	for _, path := range []string{
+		"testdata/test-newc.cpio",
+		"testdata/test-odc.cpio",
+		"testdata/test-bin.cpio",
+		initrd,
+		initrd,
+		microcode,
+		microcode,
+	} {
+		for _, name := range []string{"dir/testfile2", "dir/testfile1"} {
+			tt = append(tt, path+":"+name, path+":"+name)
+		}
+	}
+	zt.Ordered = true
+	i := 0
+	for res := range zt.Start([]string{"testdata/test-newc.cpio", "testdata/test-odc.cpio", "testdata/test-bin.cpio", initrd, microcode}) {
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		if p := strings.Join(res.Path, ":"); p != tt[i] {
+			t.Errorf("%s != %s", p, tt[i])
+		}
+		i++
+	}
+	if i != len(tt) {
+		t.Error("Too few results")
+	}
+
+	garbage := filepath.Join(t.TempDir(), "garbage.cpio")
+	if err := os.WriteFile(garbage, append(data, "garbage"...), 0666); err != nil {
+		t.Fatal(err)
+	}
+	failed := false
+	for res := range zt.Start([]string{garbage}) {
+		if res.Err != nil {
+			failed = true
+		}
+	}
+	if !failed {
+		t.Error("Expected error for data following cpio archive")
+	}
+
+	// newc header with an excessive name size (reported as an error when formats are identified only by headers)
+	zt.Detect = ztgrep.DetectMagic
+	corrupt := "070701" + strings.Repeat("00000000", 11) + "ffffffff" + "00000000"
+	path := filepath.Join(t.TempDir(), "corrupt.cpio")
+	if err := os.WriteFile(path, []byte(corrupt), 0666); err != nil {
+		t.Fatal(err)
+	}
+	i = 0
+	for res := range zt.Start([]string{path}) {
+		if res.Err == nil || res.Err.Error() != "invalid cpio header" {
+			t.Errorf("Unexpected result: %v", res)
+		}
+		i++
+	}
+	if i != 1 {
+		t.Errorf("Expected 1 result, got %d", i)
+	}
+}
+
+func TestZTgrepCompression(t *testing.T) {
+	for _, detect := range []ztgrep.Detect{ztgrep.DetectBoth, ztgrep.DetectExt} {
+		zt, err := ztgrep.New("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		zt.Detect = detect
+		zt.Lines = true
+		var paths, tt []string
+		for _, ext := range []string{"Z", "lz4", "lz", "lzma", "br"} {
+			path := "testdata/test.tar." + ext
+			paths = append(paths, path)
+			tt = append(tt,
+				path+":testfile1",
+				path+":testfile1:151",
+				path+":testfile2",
+				path+":testfile2:1",
+			)
+		}
+		zt.Ordered = true
+		i := 0
+		for res := range zt.Start(paths) {
+			if res.Err != nil {
+				t.Fatal(res.Err)
+			}
+			p := strings.Join(res.Path, ":")
+			if res.LineNum > 0 {
+				p += fmt.Sprintf(":%d", res.LineNum)
+			}
+			if p != tt[i] {
+				t.Errorf("%s != %s", p, tt[i])
+			}
+			i++
+		}
+		if i != len(tt) {
+			t.Error("Too few results")
+		}
+	}
+}
+
+func TestZTgrepISO(t *testing.T) {
+	zt, err := ztgrep.New("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := "testdata/test-iso.tar.gz"
+	tt := []string{
+		path + ":rockridge.iso:dir/nested.tar.gz:testfile2",
+		path + ":rockridge.iso:dir/nested.tar.gz:testfile2",
+		path + ":rockridge.iso:dir/sub/Long Test File Name.txt",
+		path + ":rockridge.iso:dir/testfile1",
+		path + ":rockridge.iso:dir/testfile1",
+		path + ":joliet.iso:dir/nested.tar.gz:testfile2",
+		path + ":joliet.iso:dir/nested.tar.gz:testfile2",
+		path + ":joliet.iso:dir/sub/Long Test File Name.txt",
+		path + ":joliet.iso:dir/testfile1",
+		path + ":joliet.iso:dir/testfile1",
+		path + ":plain.iso:DIR/NESTED_T.GZ:testfile2",
+		path + ":plain.iso:DIR/NESTED_T.GZ:testfile2",
+		path + ":plain.iso:DIR/SUB/LONG_TES.TXT",
+		path + ":plain.iso:DIR/TESTFILE",
+	}
+	i := 0
+	for res := range zt.Start([]string{path}) {
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		if p := strings.Join(res.Path, ":"); p != tt[i] {
+			t.Errorf("%s != %s", p, tt[i])
+		}
+		if res.Path[1] == "rockridge.iso" && res.Info.Mode() != 0644 {
+			t.Errorf("Invalid mode: %s", res.Info.Mode())
+		}
+		i++
+	}
+	if i != len(tt) {
+		t.Error("Too few results")
+	}
+
+	// root directory larger than the image
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(zr)
+	var data []byte
+	for h, err := tr.Next(); data == nil; h, err = tr.Next() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Name == "plain.iso" {
+			if data, err = io.ReadAll(tr); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	binary.LittleEndian.PutUint32(data[16*2048+156+10:], 0x7fffffff)
+	path = filepath.Join(t.TempDir(), "corrupt.iso")
+	if err := os.WriteFile(path, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	i = 0
+	for res := range zt.Start([]string{path}) {
+		if res.Err == nil || res.Err.Error() != "invalid iso9660 image" {
+			t.Errorf("Unexpected result: %v", res)
+		}
+		i++
+	}
+	if i != 1 {
+		t.Errorf("Expected 1 result, got %d", i)
+	}
+}
+
+// writeImage writes an OCI image layout with the given layers to dir, as well as a docker-save style tarball.
+// It returns the path of the tarball and the digests of the layers.
+func writeImage(t *testing.T, dir, ref string, layers ...string) (string, []string) {
+	t.Helper()
+	files := map[string][]byte{"oci-layout": []byte(`{"imageLayoutVersion":"1.0.0"}`)}
+	blob := func(data []byte) string {
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+		files["blobs/sha256/"+digest[7:]] = data
+		return digest
+	}
+	var digests, paths []string
+	for _, l := range layers {
+		data, err := os.ReadFile(l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		digests = append(digests, blob(data))
+		paths = append(paths, "blobs/sha256/"+digests[len(digests)-1][7:])
+	}
+	config := blob([]byte(`{"rootfs":{"type":"layers","diff_ids":[]}}`))
+	var layerDescs []string
+	for _, d := range digests {
+		layerDescs = append(layerDescs, fmt.Sprintf(`{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip","digest":%q}`, d))
+	}
+	manifest := blob([]byte(fmt.Sprintf(`{"schemaVersion":2,"config":{"digest":%q},"layers":[%s]}`, config, strings.Join(layerDescs, ","))))
+	files["index.json"] = []byte(fmt.Sprintf(`{"schemaVersion":2,"manifests":[{"digest":%q,"annotations":{"org.opencontainers.image.ref.name":%q}}]}`, manifest, ref))
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, files[name], 0666); err != nil {
+			t.Fatal(err)
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name]))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(files[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dockerManifest := fmt.Sprintf(`[{"Config":"blobs/sha256/%s","RepoTags":[%q],"Layers":["%s"]}]`, config[7:], ref, strings.Join(paths, `","`))
+	if err := tw.WriteHeader(&tar.Header{Name: "manifest.json", Mode: 0644, Size: int64(len(dockerManifest))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte(dockerManifest)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "image.tar")
+	if err := os.WriteFile(path, buf.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return path, digests
+}
+
+func TestZTgrepImages(t *testing.T) {
+	zt, err := ztgrep.New("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zt.Images = true
+	zt.Ordered = true
+	dir := filepath.Join(t.TempDir(), "layout")
+	image, digests := writeImage(t, dir, "test:latest",
+		writeTarGz(t, "layer1.tar.gz", "etc/secret", "secret\n", "etc/other", "none\n"),
+		writeTarGz(t, "layer2.tar.gz", "etc/secret", "none\n", "etc/config", "secret\n"),
+	)
+	var tt []string
+	for _, path := range []string{image, dir} {
+		tt = append(tt,
+			path+":test:latest:"+digests[0]+":etc/secret",
+			path+":test:latest:"+digests[0]+":etc/secret",
+			path+":test:latest:"+digests[1]+":etc/secret",
+			path+":test:latest:"+digests[1]+":etc/config",
+		)
+	}
+	i := 0
+	for res := range zt.Start([]string{image, dir}) {
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		if p := strings.Join(res.Path, ":"); p != tt[i] {
+			t.Errorf("%s != %s", p, tt[i])
+		}
+		i++
+	}
+	if i != len(tt) {
+		t.Error("Too few results")
+	}
+
+	// tar files too large to index are searched normally
+	zt.MaxZipSize = 1024
+	path := writeTarGz(t, "large.tar.gz", "large", strings.Repeat("x", 4096)+"secret\n")
+	i = 0
+	for res := range zt.Start([]string{path}) {
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		if p := strings.Join(res.Path, ":"); p != path+":large" {
+			t.Errorf("%s != %s:large", p, path)
+		}
+		i++
+	}
+	if i != 1 {
+		t.Errorf("Expected 1 result, got %d", i)
+	}
+}
+
+func TestZTgrepMergeLayers(t *testing.T) {
+	zt, err := ztgrep.New("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zt.Images = true
+	zt.MergeLayers = true
+	image, digests := writeImage(t, filepath.Join(t.TempDir(), "layout"), "test:latest",
+		writeTarGz(t, "layer1.tar.gz",
+			"etc/secret", "secret\n",
+			"etc/removed", "secret\n",
+			"etc/replaced", "secret\n",
+			"opt/dir/a", "secret\n",
+		),
+		writeTarGz(t, "layer2.tar.gz",
+			"etc/.wh.removed", "",
+			"etc/replaced", "secret\n",
+			"opt/dir/.wh..wh..opq", "",
+			"opt/dir/b", "secret\n",
+		),
+	)
+	tt := []string{
+		image + ":test:latest:" + digests[0] + ":etc/secret",
+		image + ":test:latest:" + digests[0] + ":etc/secret",
+		image + ":test:latest:" + digests[1] + ":etc/replaced",
+		image + ":test:latest:" + digests[1] + ":opt/dir/b",
+	}
+	i := 0
+	for res := range zt.Start([]string{image}) {
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		if p := strings.Join(res.Path, ":"); p != tt[i] {
+			t.Errorf("%s != %s", p, tt[i])
+		}
+		i++
+	}
+	if i != len(tt) {
+		t.Error("Too few results")
+	}
+}
+
+func TestZTgrepPathMatch(t *testing.T) {
+	zt, err := ztgrep.New(`^testdata/test-l2\.tar\.gz!test-l1\.tar!.*\.tar\.(gz|xz)(!testfile1)?$`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zt.PathMatch = true
+	zt.PathSeparator = "!"
+	zt.SkipBody = true
+	tt := []string{
+		"testdata/test-l2.tar.gz:test-l1.tar:test.tar.gz",
+		"testdata/test-l2.tar.gz:test-l1.tar:test.tar.gz:testfile1",
+		"testdata/test-l2.tar.gz:test-l1.tar:test.tar.xz",
+		"testdata/test-l2.tar.gz:test-l1.tar:test.tar.xz:testfile1",
+	}
+	var results []string
+	for res := range zt.Start([]string{"testdata/test-l2.tar.gz"}) {
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		results = append(results, strings.Join(res.Path, ":"))
+	}
+	sort.Strings(results)
+	if strings.Join(results, "\n") != strings.Join(tt, "\n") {
+		t.Errorf("Unexpected results:\n%s", strings.Join(results, "\n"))
+	}
+
+	zt, err = ztgrep.New(`l2\.tar\.gz$`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zt.PathMatch = true
+	zt.SkipBody = true
+	i := 0
+	for res := range zt.Start([]string{"testdata/test-l2.tar.gz"}) {
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		if p := strings.Join(res.Path, ":"); p != "testdata/test-l2.tar.gz" {
+			t.Errorf("%s != testdata/test-l2.tar.gz", p)
+		}
+		i++
+	}
+	if i != 1 {
+		t.Errorf("Expected 1 result, got %d", i)
+	}
+}
+
+func TestZTgrepAllNames(t *testing.T) {
+	for _, allNames := range []bool{false, true} {
+		zt, err := ztgrep.New(`^test\.tar(\.gz)?$|l2\.tar$`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zt.AllNames = allNames
+		zt.SkipBody = true
+		var tt []string
+		if allNames {
+			tt = append(tt, "testdata/test-l2.tar.gz")
+		}
+		for _, prefix := range []string{"", "test-l1.tar.zst:", "test-l1.tar:"} {
+			if allNames {
+				tt = append(tt, "testdata/test-l2.tar.gz:"+prefix+"test.tar.bz2")
+			}
+			tt = append(tt, "testdata/test-l2.tar.gz:"+prefix+"test.tar.gz")
+			if allNames {
+				tt = append(tt,
+					"testdata/test-l2.tar.gz:"+prefix+"test.tar.xz",
+					"testdata/test-l2.tar.gz:"+prefix+"test.tar.zst",
+				)
+			}
+		}
+		sort.Strings(tt)
+		var results []string
+		for res := range zt.Start([]string{"testdata/test-l2.tar.gz"}) {
+			if res.Err != nil {
+				t.Fatal(res.Err)
+			}
+			results = append(results, strings.Join(res.Path, ":"))
+		}
+		sort.Strings(results)
+		if strings.Join(results, "\n") != strings.Join(tt, "\n") {
+			t.Errorf("Unexpected results with AllNames=%t:\n%s", allNames, strings.Join(results, "\n"))
+		}
+	}
+}
+
+func TestZTgrepSplit(t *testing.T) {
+	for _, requireName := range []bool{false, true} {
+		zt, err := ztgrep.NewSplit(`^testfile1$`, `test`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zt.RequireName = requireName
+		names, bodies := 0, 0
+		for res := range zt.Start([]string{"testdata/test-l2.tar.gz"}) {
+			if res.Err != nil {
+				t.Fatal(res.Err)
+			}
+			if res.Body {
+				bodies++
+			} else {
+				names++
+			}
+			if requireName && res.Path[len(res.Path)-1] != "testfile1" {
+				t.Errorf("Unexpected result with RequireName: %s", strings.Join(res.Path, ":"))
+			}
+		}
+		if requireName && (names != 0 || bodies != 15) {
+			t.Errorf("Expected 0 name and 15 body results with RequireName, got %d and %d", names, bodies)
+		}
+		if !requireName && (names != 15 || bodies != 45) {
+			t.Errorf("Expected 15 name and 45 body results, got %d and %d", names, bodies)
+		}
+	}
+
+	zt, err := ztgrep.NewSplit(`^testfile1$`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for res := range zt.Start([]string{"testdata/test-l2.tar.gz"}) {
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		if res.Body {
+			t.Errorf("Unexpected body result: %s", strings.Join(res.Path, ":"))
+		}
+	}
+	if _, err := ztgrep.NewSplit("", "("); err == nil {
+		t.Error("Expected error for invalid body expression")
+	}
+}